@@ -0,0 +1,99 @@
+package mdpp
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	mtext "github.com/yuin/goldmark/text"
+)
+
+// getLinkDestinations returns the destinations of the links in the Markdown
+// document.
+func getLinkDestinations(p string) ([]string, error) {
+	source, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	doc := goldmark.New().Parser().Parse(mtext.NewReader(source))
+	var destinations []string
+	err = ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if link, ok := node.(*ast.Link); ok && entering {
+			destinations = append(destinations, string(link.Destination))
+		}
+		return ast.WalkContinue, nil
+	})
+	return destinations, err
+}
+
+// resolveLocalLink resolves the destination of a link in the document of the
+// path to a local file path, or returns "" if it is not a relative link.
+func resolveLocalLink(docPath string, destination string) string {
+	if i := strings.IndexAny(destination, "#?"); i >= 0 {
+		destination = destination[:i]
+	}
+	if destination == "" || strings.HasPrefix(destination, "/") {
+		return ""
+	}
+	u, err := url.Parse(destination)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return ""
+	}
+	return filepath.FromSlash(path.Join(path.Dir(docPath), u.Path))
+}
+
+// linksTo reports whether the Markdown document of the path has a link to the
+// file whose path is resolved to targetPath.
+func linksTo(p string, targetPath string) (bool, error) {
+	destinations, err := getLinkDestinations(p)
+	if err != nil {
+		return false, err
+	}
+	for _, destination := range destinations {
+		linked := resolveLocalLink(p, destination)
+		if linked == "" {
+			continue
+		}
+		if resolved, err := filepath.EvalSymlinks(linked); err == nil {
+			if resolved, err = filepath.Abs(resolved); err == nil && resolved == targetPath {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// writeBacklinks writes the index of the documents matching the pattern which
+// link to the including document.
+func writeBacklinks(writer io.Writer, elem *mdppIndexElem, indent string, includerPath string, titlePolicy TitlePolicy) error {
+	includerPath, err := filepath.EvalSymlinks(includerPath)
+	if err != nil {
+		return err
+	}
+	if includerPath, err = filepath.Abs(includerPath); err != nil {
+		return err
+	}
+	entries, err := collectIndexEntries(elem, includerPath, titlePolicy)
+	if err != nil {
+		return err
+	}
+	var linking []*indexEntry
+	for _, entry := range entries {
+		if entry.isSelf || !IsMarkdownFile(entry.path) {
+			continue
+		}
+		ok, err := linksTo(entry.path, includerPath)
+		if err != nil {
+			return err
+		}
+		if ok {
+			linking = append(linking, entry)
+		}
+	}
+	return writeIndexOf(writer, elem, linking, indent, includerPath, titlePolicy)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/knaka/mdpp"
@@ -30,6 +32,43 @@ func waitForDebugger() {
 	}
 }
 
+// Exit status when a file outside the root directory is to be read
+const exitOutsideRoot = 3
+
+// getGitRoot returns the top directory of the Git working tree which contains
+// the directory, or "" if there is none.
+func getGitRoot(dir string) string {
+	cmd := exec.Command("git", "rev-parse", "--show-toplevel")
+	cmd.Dir = dir
+	if output, err := cmd.Output(); err == nil {
+		return strings.TrimSpace(string(output))
+	}
+	return ""
+}
+
+// isInside reports whether the path is the directory or under it after
+// resolving symbolic links.
+func isInside(path string, dir string) bool {
+	resolve := func(p string) string {
+		if resolved, err := filepath.EvalSymlinks(p); err == nil {
+			p = resolved
+		}
+		abs, _ := filepath.Abs(p)
+		return abs
+	}
+	rel, err := filepath.Rel(resolve(dir), resolve(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// exitWithPreprocessError exits with the status by the error.
+func exitWithPreprocessError(err error) {
+	if errors.Is(err, mdpp.ErrOutsideRoot) {
+		_, _ = fmt.Fprintln(os.Stderr, "Failed to preprocess:", err.Error())
+		os.Exit(exitOutsideRoot)
+	}
+	log.Fatal("Failed to preprocess: ", err.Error())
+}
+
 func main() {
 	waitForDebugger()
 	var outPath string
@@ -38,11 +77,93 @@ func main() {
 	flag.BoolVarP(&shouldPrintHelp, "help", "h", false, "Show Help")
 	var inPlace bool
 	flag.BoolVarP(&inPlace, "in-place", "i", false, "Edit file(s) in place")
+	var titlePolicyName string
+	flag.StringVarP(&titlePolicyName, "title-policy", "", mdpp.FrontMatterThenHeadingPolicy.String(),
+		"Where to get titles from (front-matter-then-heading, front-matter-only, heading-only)")
+	var configPath string
+	flag.StringVarP(&configPath, "config", "", "", "Configuration file instead of .mdpp.yaml or .mdpp.toml found from the document")
+	var rootDir string
+	flag.StringVarP(&rootDir, "root", "", "", "Directory out of which no file is read (default: the root in the configuration or of the Git repository, or the directory of the document)")
+	var allowExec bool
+	flag.BoolVarP(&allowExec, "allow-exec", "", false, "Allow custom directives to execute commands (implied by --config)")
+	var definitions []string
+	flag.StringArrayVarP(&definitions, "define", "D", nil, "Define a variable as name=value (repeatable)")
 	flag.Parse()
 	if shouldPrintHelp {
 		flag.Usage()
 		os.Exit(0)
 	}
+	titlePolicy, err := mdpp.ParseTitlePolicy(titlePolicyName)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	variables := map[string]string{}
+	for _, definition := range definitions {
+		i := strings.Index(definition, "=")
+		if i <= 0 {
+			_, _ = fmt.Fprintln(os.Stderr, "Invalid variable definition:", definition)
+			os.Exit(1)
+		}
+		variables[definition[:i]] = definition[i+1:]
+	}
+	// Configuration files found from the documents are not trusted to execute
+	// commands
+	baseOptions := mdpp.Options{TitlePolicy: titlePolicy, Variables: variables, AllowExec: allowExec || configPath != ""}
+	configs := map[string]*mdpp.Config{}
+	// getOptions returns the options with the configuration for the documents
+	// in the directory.
+	getOptions := func(dir string) *mdpp.Options {
+		options := baseOptions
+		options.Root = rootDir
+		gitRoot := ""
+		if options.Root == "" {
+			// The directory of the documents if not in a Git working tree
+			if gitRoot = getGitRoot(dir); gitRoot != "" {
+				options.Root = gitRoot
+			} else {
+				var err error
+				if options.Root, err = filepath.Abs(dir); err != nil {
+					log.Fatal("Error", err.Error())
+				}
+			}
+		}
+		path := configPath
+		if path == "" {
+			var err error
+			if path, err = mdpp.FindConfigFile(dir); err != nil {
+				log.Fatal("Failed to find configuration: ", err.Error())
+			}
+			if path == "" {
+				return &options
+			}
+		}
+		config, ok := configs[path]
+		if !ok {
+			var err error
+			if config, err = mdpp.LoadConfig(path); err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, "Invalid configuration:", err.Error())
+				os.Exit(1)
+			}
+			configs[path] = config
+		}
+		options.Config = config
+		if rootDir == "" {
+			// A configuration found from the document can only narrow the
+			// Git working tree if any, while the given one is trusted
+			switch {
+			case configPath != "" || gitRoot == "" || isInside(config.Root, options.Root):
+				options.Root = config.Root
+			case isInside(filepath.Dir(config.Path), options.Root):
+				_, _ = fmt.Fprintln(os.Stderr, "Invalid configuration:", config.Path+": root outside the Git working tree:", config.Root)
+				os.Exit(1)
+			}
+		}
+		if config.TitlePolicy != nil && !flag.CommandLine.Changed("title-policy") {
+			options.TitlePolicy = *config.TitlePolicy
+		}
+		return &options
+	}
 	if inPlace {
 		if outPath != "" {
 			_, _ = fmt.Fprintln(os.Stderr, "Do not specify \"outfile\" and \"in-place\" simultaneously")
@@ -56,6 +177,10 @@ func main() {
 	args := flag.Args()
 	if inPlace {
 		for _, inPath := range args {
+			options := getOptions(filepath.Dir(inPath))
+			if options.Config.IsIgnored(inPath) {
+				continue
+			}
 			var err error
 			func() {
 				var inFile *os.File
@@ -81,7 +206,7 @@ func main() {
 					}
 				}
 				var changed bool
-				_, changed, err = mdpp.Preprocess(bufOut, inFile, filepath.Dir(inPath), absPath)
+				_, changed, err = mdpp.PreprocessWithOptions(bufOut, inFile, filepath.Dir(inPath), absPath, options)
 				if err != nil {
 					return
 				}
@@ -109,7 +234,7 @@ func main() {
 				}
 			}()
 			if err != nil {
-				log.Fatalln("Failed to preprocess: ", err.Error())
+				exitWithPreprocessError(err)
 			}
 		}
 	} else {
@@ -166,10 +291,16 @@ func main() {
 				} else {
 					workDir = filepath.Dir(inPath)
 				}
-				_, _, err = mdpp.Preprocess(output, inFile, workDir, absPath)
+				options := getOptions(workDir)
+				if inPath != "-" && options.Config.IsIgnored(inPath) {
+					// Output as it is
+					_, err = io.Copy(output, inFile)
+					return
+				}
+				_, _, err = mdpp.PreprocessWithOptions(output, inFile, workDir, absPath, options)
 			}()
 			if err != nil {
-				log.Fatal("Failed to preprocess: ", err.Error())
+				exitWithPreprocessError(err)
 			}
 		}
 	}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"strings"
 	"time"
 
 	"github.com/knaka/mdpp"
+
+	flag "github.com/spf13/pflag"
 )
 
 func waitForDebugger() {
@@ -23,10 +29,119 @@ func waitForDebugger() {
 	}
 }
 
+type jsonOutput struct {
+	Path     string        `json:"path"`
+	Style    string        `json:"style"`
+	Title    string        `json:"title"`
+	Metadata mdpp.Metadata `json:"metadata"`
+}
+
+func readInput(inPath string) ([]byte, error) {
+	if inPath == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(inPath)
+}
+
+// setTitle rewrites the title of the file in place, or filters the standard
+// input to the standard output.
+func setTitle(inPath string, title string) error {
+	source, err := readInput(inPath)
+	if err != nil {
+		return err
+	}
+	output, err := mdpp.SetMarkdownTitle(source, title)
+	if err != nil {
+		return err
+	}
+	if inPath == "-" {
+		_, err = os.Stdout.Write(output)
+		return err
+	}
+	if bytes.Equal(source, output) {
+		return nil
+	}
+	info, err := os.Stat(inPath)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(inPath, output, info.Mode().Perm())
+}
+
 func main() {
 	waitForDebugger()
-	for _, inPath := range os.Args[1:] {
-		title := mdpp.GetMarkdownTitle(inPath)
-		fmt.Println(title)
+	var shouldPrintHelp bool
+	flag.BoolVarP(&shouldPrintHelp, "help", "h", false, "Show Help")
+	var fields []string
+	flag.StringArrayVarP(&fields, "field", "f", nil, "Print the metadata field instead of the title (repeatable)")
+	var outputsJson bool
+	flag.BoolVarP(&outputsJson, "json", "j", false, "Print all the metadata as JSON")
+	var printsStyle bool
+	flag.BoolVarP(&printsStyle, "style", "s", false, "Print the detected metadata style")
+	var newTitle string
+	flag.StringVarP(&newTitle, "set", "", "", "Rewrite the title of the file(s) in place")
+	var titlePolicyName string
+	flag.StringVarP(&titlePolicyName, "title-policy", "", mdpp.FrontMatterThenHeadingPolicy.String(),
+		"Where to get titles from (front-matter-then-heading, front-matter-only, heading-only)")
+	flag.Parse()
+	if shouldPrintHelp {
+		flag.Usage()
+		os.Exit(0)
+	}
+	titlePolicy, err := mdpp.ParseTitlePolicy(titlePolicyName)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	args := flag.Args()
+	if len(args) == 0 {
+		args = append(args, "-")
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	exitStatus := 0
+	if flag.CommandLine.Changed("set") {
+		for _, inPath := range args {
+			if err := setTitle(inPath, newTitle); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "Failed to set title: %s: %s\n", inPath, err.Error())
+				exitStatus = 1
+			}
+		}
+		os.Exit(exitStatus)
+	}
+	for _, inPath := range args {
+		source, err := readInput(inPath)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, "Failed to read file:", err.Error())
+			exitStatus = 1
+			continue
+		}
+		metadata, style, err := mdpp.GetMarkdownMetadataSub(bytes.NewReader(source))
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Failed to parse metadata: %s: %s\n", inPath, err.Error())
+			exitStatus = 1
+			continue
+		}
+		title := mdpp.GetMarkdownTitleSubWithPolicy(bytes.NewReader(source), inPath, titlePolicy)
+		if outputsJson {
+			if err := encoder.Encode(&jsonOutput{inPath, style.String(), title, metadata}); err != nil {
+				log.Fatal("Failed to write: ", err.Error())
+			}
+			continue
+		}
+		var columns []string
+		if printsStyle {
+			columns = append(columns, style.String())
+		}
+		if len(fields) > 0 {
+			for _, field := range fields {
+				value, _ := metadata.GetString(field)
+				columns = append(columns, value)
+			}
+		} else {
+			columns = append(columns, title)
+		}
+		fmt.Println(strings.Join(columns, "\t"))
 	}
+	os.Exit(exitStatus)
 }
@@ -0,0 +1,56 @@
+package mdpp
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// Disabled branches of mdppif are commented out as "<!-- mdppoff ... -->" with
+// "-->" in them escaped as "--\>" ("--\>" as "--\\>" and so on) so that they
+// can be restored as they were.
+
+const disabledBegin = "<!-- mdppoff"
+
+var reCommentEnd = regexp.MustCompile(`--(\\*)>`)
+var reEscapedCommentEnd = regexp.MustCompile(`--\\(\\*)>`)
+var reDisabled = regexp.MustCompile(`(?s)^[ \t]*<!-- mdppoff\n(.*?)[ \t]*-->\n$`)
+
+// disableBranch comments out the content of the branch.
+func disableBranch(content []byte, indent string) []byte {
+	if len(bytes.TrimSpace(content)) == 0 {
+		return content
+	}
+	escaped := reCommentEnd.ReplaceAll(content, []byte(`--\${1}>`))
+	return concatBytes([]byte(indent+disabledBegin+"\n"), escaped, []byte(indent+"-->\n"))
+}
+
+// enableBranch restores the content of the branch commented out by
+// disableBranch. The second result is false if it was not.
+func enableBranch(content []byte) ([]byte, bool) {
+	match := reDisabled.FindSubmatch(content)
+	if match == nil {
+		return content, false
+	}
+	return reEscapedCommentEnd.ReplaceAll(match[1], []byte(`--${1}>`)), true
+}
+
+// dedentLines removes the indent from the head of the lines.
+func dedentLines(content []byte, indent string) []byte {
+	lines := strings.SplitAfter(string(content), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(line, indent)
+	}
+	return []byte(strings.Join(lines, ""))
+}
+
+// indentLines adds the indent to the head of the non-empty lines.
+func indentLines(content []byte, indent string) []byte {
+	lines := strings.SplitAfter(string(content), "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			lines[i] = indent + line
+		}
+	}
+	return []byte(strings.Join(lines, ""))
+}
@@ -0,0 +1,439 @@
+package mdpp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Names of the project configuration files, which are searched for from the
+// directory of the document up to the root.
+var configFileNames = []string{".mdpp.yaml", ".mdpp.yml", ".mdpp.toml"}
+
+// Config is the project configuration.
+type Config struct {
+	// Path of the configuration file
+	Path string
+	// Absolute path of the root directory of the project. The directory of the
+	// configuration file by default.
+	Root string
+	// Title policy if configured
+	TitlePolicy *TitlePolicy
+	// Variables substituted by mdppvar
+	Variables Metadata
+	// Default attributes by the directives
+	Defaults map[string]map[string]string
+	// Patterns of the paths relative to the root, which are not preprocessed
+	// nor listed by mdppindex
+	Ignore []string
+	// Commands which custom directives are allowed to execute
+	Exec []string
+	// Custom directives by the names
+	Directives map[string]*Directive
+}
+
+// Directive is a custom directive which replaces the enclosed content with the
+// output of the template or the command.
+type Directive struct {
+	// Absolute path of the template file, which is executed with the
+	// attributes
+	Template string
+	// Command and arguments, executed with the attributes in the environment
+	// variables MDPP_ATTR_<NAME>
+	Command []string
+}
+
+// Names of the built-in directives, which custom ones cannot override
+var builtinDirectives = map[string]bool{
+	"mdpplink": true, "mdppcode": true, "mdppindex": true, "mdppbacklinks": true,
+	"mdpptree": true, "mdppcsv": true, "mdpptemplate": true, "mdppvar": true,
+	"mdppif": true, "mdppelse": true, "mdppoff": true, "mdppdiff": true,
+}
+
+var reDirectiveName = regexp.MustCompile(`^mdpp[_a-zA-Z0-9]+$`)
+
+// FindConfigFile returns the path of the configuration file for the documents
+// in the directory, or "" if there is none.
+func FindConfigFile(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		for _, name := range configFileNames {
+			path := filepath.Join(dir, name)
+			if info, err := os.Stat(path); err == nil && !info.IsDir() {
+				return path, nil
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// configLoader validates the fields and reports the errors with the lines.
+type configLoader struct {
+	path   string
+	source []byte
+	isToml bool
+	dir    string
+}
+
+func (loader *configLoader) errorf(keys []string, format string, args ...interface{}) error {
+	line := findKeyLine(loader.source, loader.isToml, keys)
+	return fmt.Errorf("%s:%d: %s", loader.path, line, fmt.Sprintf(format, args...))
+}
+
+func (loader *configLoader) getMap(value interface{}, keys ...string) (map[string]interface{}, error) {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, loader.errorf(keys, "\"%s\" must be a mapping", strings.Join(keys, "."))
+	}
+	return m, nil
+}
+
+func (loader *configLoader) getString(value interface{}, keys ...string) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", loader.errorf(keys, "\"%s\" must be a string", strings.Join(keys, "."))
+	}
+	return s, nil
+}
+
+// getStrings accepts a list of strings or a string.
+func (loader *configLoader) getStrings(value interface{}, keys ...string) ([]string, error) {
+	if s, ok := value.(string); ok {
+		return []string{s}, nil
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, loader.errorf(keys, "\"%s\" must be a list of strings", strings.Join(keys, "."))
+	}
+	var strs []string
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, loader.errorf(keys, "\"%s\" must be a list of strings", strings.Join(keys, "."))
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// LoadConfig reads the configuration file in YAML or TOML.
+func LoadConfig(path string) (*Config, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := parseData(source, path)
+	if err != nil {
+		return nil, err
+	}
+	loader := &configLoader{path, source, strings.ToLower(filepath.Ext(path)) == ".toml", filepath.Dir(absPath)}
+	config := &Config{
+		Path:       path,
+		Root:       loader.dir,
+		Variables:  Metadata{},
+		Defaults:   map[string]map[string]string{},
+		Directives: map[string]*Directive{},
+	}
+	if data == nil {
+		return config, nil
+	}
+	fields, err := loader.getMap(data)
+	if err != nil {
+		return nil, err
+	}
+	// Commands are checked after the allow-list is read
+	var directiveKeys []string
+	for _, key := range sortedKeys(fields) {
+		value := fields[key]
+		switch key {
+		case "root":
+			root, err := loader.getString(value, key)
+			if err != nil {
+				return nil, err
+			}
+			if !filepath.IsAbs(root) {
+				root = filepath.Join(loader.dir, root)
+			}
+			if info, err := os.Stat(root); err != nil || !info.IsDir() {
+				return nil, loader.errorf([]string{key}, "root is not a directory: %s", root)
+			}
+			config.Root = filepath.Clean(root)
+		case "title-policy":
+			name, err := loader.getString(value, key)
+			if err != nil {
+				return nil, err
+			}
+			policy, err := ParseTitlePolicy(name)
+			if err != nil {
+				return nil, loader.errorf([]string{key}, "%s", err.Error())
+			}
+			config.TitlePolicy = &policy
+		case "variables":
+			variables, err := loader.getMap(value, key)
+			if err != nil {
+				return nil, err
+			}
+			config.Variables = newMetadata(variables)
+		case "defaults":
+			defaults, err := loader.getMap(value, key)
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range sortedKeys(defaults) {
+				attrs, err := loader.getMap(defaults[name], key, name)
+				if err != nil {
+					return nil, err
+				}
+				config.Defaults[name] = map[string]string{}
+				for _, attr := range sortedKeys(attrs) {
+					switch attrs[attr].(type) {
+					case map[string]interface{}, []interface{}, nil:
+						return nil, loader.errorf([]string{key, name, attr}, "attribute \"%s\" must be a scalar", attr)
+					}
+					config.Defaults[name][attr] = metadataString(attrs[attr])
+				}
+			}
+		case "ignore":
+			if config.Ignore, err = loader.getStrings(value, key); err != nil {
+				return nil, err
+			}
+		case "exec":
+			if config.Exec, err = loader.getStrings(value, key); err != nil {
+				return nil, err
+			}
+		case "directives":
+			directives, err := loader.getMap(value, key)
+			if err != nil {
+				return nil, err
+			}
+			directiveKeys = sortedKeys(directives)
+			for _, name := range directiveKeys {
+				if !reDirectiveName.MatchString(name) {
+					return nil, loader.errorf([]string{key, name}, "directive name must start with \"mdpp\": %s", name)
+				}
+				if builtinDirectives[name] {
+					return nil, loader.errorf([]string{key, name}, "built-in directive cannot be redefined: %s", name)
+				}
+				def, err := loader.getMap(directives[name], key, name)
+				if err != nil {
+					return nil, err
+				}
+				directive := &Directive{}
+				for _, field := range sortedKeys(def) {
+					switch field {
+					case "template":
+						if directive.Template, err = loader.getString(def[field], key, name, field); err != nil {
+							return nil, err
+						}
+						if !filepath.IsAbs(directive.Template) {
+							directive.Template = filepath.Join(loader.dir, directive.Template)
+						}
+					case "command":
+						if directive.Command, err = loader.getStrings(def[field], key, name, field); err != nil {
+							return nil, err
+						}
+						if len(directive.Command) == 1 {
+							directive.Command = strings.Fields(directive.Command[0])
+						}
+						if len(directive.Command) == 0 {
+							return nil, loader.errorf([]string{key, name, field}, "empty command")
+						}
+					default:
+						return nil, loader.errorf([]string{key, name, field}, "unknown field: %s", field)
+					}
+				}
+				if (directive.Template == "") == (directive.Command == nil) {
+					return nil, loader.errorf([]string{key, name}, "either \"template\" or \"command\" is required: %s", name)
+				}
+				config.Directives[name] = directive
+			}
+		default:
+			return nil, loader.errorf([]string{key}, "unknown field: %s", key)
+		}
+	}
+	for _, name := range directiveKeys {
+		directive := config.Directives[name]
+		if directive.Command != nil && !config.isExecAllowed(directive.Command[0]) {
+			return nil, loader.errorf([]string{"directives", name, "command"}, "command not allowed by \"exec\": %s", directive.Command[0])
+		}
+	}
+	return config, nil
+}
+
+func (config *Config) isExecAllowed(command string) bool {
+	for _, allowed := range config.Exec {
+		if allowed == command {
+			return true
+		}
+	}
+	return false
+}
+
+// IsIgnored reports whether the file is ignored by the configuration.
+func (config *Config) IsIgnored(path string) bool {
+	if config == nil || len(config.Ignore) == 0 {
+		return false
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(config.Root, absPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	names := strings.Split(filepath.ToSlash(rel), "/")
+	patterns, err := expandBraces(config.Ignore)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		segments := strings.Split(strings.Trim(filepath.ToSlash(pattern), "/"), "/")
+		// Ignoring a directory ignores the files in it
+		for i := len(segments); i <= len(names); i++ {
+			if matchSegments(segments, names[:i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyDefaults sets the default attributes of the directive which are not
+// given.
+func (config *Config) applyDefaults(command string, attrs mdppAttributes) {
+	if config == nil {
+		return
+	}
+	for key, value := range config.Defaults[command] {
+		if _, ok := attrs[key]; !ok {
+			attrs[key] = value
+		}
+	}
+}
+
+// write writes the output of the custom directive with the indent.
+func (directive *Directive) write(writer io.Writer, attrs mdppAttributes, lookup lookupFunc, indent string, titlePolicy TitlePolicy, sb *sandbox) error {
+	if directive.Template != "" {
+		data := map[string]interface{}{}
+		for key, value := range attrs {
+			data[key] = value
+		}
+		funcs := getTemplateFuncs(titlePolicy, sb)
+		funcs["var"] = func(name string) interface{} {
+			value, _ := lookup(name)
+			return value
+		}
+		return executeTemplateFile(writer, directive.Template, data, funcs, indent)
+	}
+	cmd := exec.Command(directive.Command[0], directive.Command[1:]...)
+	cmd.Env = os.Environ()
+	for key, value := range attrs {
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		cmd.Env = append(cmd.Env, "MDPP_ATTR_"+name+"="+value)
+	}
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("%s: %s: %s", directive.Command[0], err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return writeIndentedText(writer, string(output), indent)
+}
+
+var reYamlKeyLine = regexp.MustCompile(`^(\s*)("[^"]*"|'[^']*'|[^\s#'"-][^:#]*?)\s*:(?:\s|$)`)
+var reTomlTableLine = regexp.MustCompile(`^\s*\[\[?\s*([^\]]+?)\s*\]\]?`)
+var reTomlKeyLine = regexp.MustCompile(`^\s*([A-Za-z0-9_."' -]+?)\s*=`)
+
+func splitTomlKey(key string) []string {
+	var names []string
+	for _, name := range strings.Split(key, ".") {
+		names = append(names, strings.Trim(strings.TrimSpace(name), `"'`))
+	}
+	return names
+}
+
+func hasKeyPrefix(keys []string, prefix []string) bool {
+	if len(prefix) > len(keys) {
+		return false
+	}
+	for i, name := range prefix {
+		if keys[i] != name {
+			return false
+		}
+	}
+	return true
+}
+
+// findKeyLine returns the line number where the keys are defined in the YAML
+// or TOML source, or where the nearest parent is if they are not found. It
+// returns 1 if none is found.
+func findKeyLine(source []byte, isToml bool, keys []string) int {
+	best, bestDepth := 1, 0
+	found := func(lineNo int, path []string) {
+		if len(path) > bestDepth && hasKeyPrefix(keys, path) {
+			best, bestDepth = lineNo, len(path)
+		}
+	}
+	type yamlKey struct {
+		indent int
+		name   string
+	}
+	var stack []yamlKey
+	var table []string
+	for i, line := range strings.Split(string(source), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		if isToml {
+			if match := reTomlTableLine.FindStringSubmatch(line); match != nil {
+				table = splitTomlKey(match[1])
+				found(i+1, table)
+			} else if match := reTomlKeyLine.FindStringSubmatch(line); match != nil {
+				found(i+1, append(append([]string(nil), table...), splitTomlKey(match[1])...))
+			}
+			continue
+		}
+		match := reYamlKeyLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		indent := len(match[1])
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		stack = append(stack, yamlKey{indent, strings.Trim(match[2], `"'`)})
+		var path []string
+		for _, key := range stack {
+			path = append(path, key.name)
+		}
+		found(i+1, path)
+	}
+	return best
+}
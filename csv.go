@@ -0,0 +1,204 @@
+package mdpp
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// csvOptions are the options of mdppcsv.
+type csvOptions struct {
+	// Comma-separated names or 1-based numbers of the columns optionally
+	// followed by ":" and a label. All the columns if empty.
+	columns string
+	// Comma-separated alignments of the columns: left, center, right or none
+	align string
+	// Whether the first row is the header
+	header bool
+	// The field delimiter. Guessed from the extension if zero.
+	delimiter rune
+}
+
+type csvColumn struct {
+	index int
+	label string
+}
+
+// parseCsvDelimiter parses the delimiter attribute, which is a character or
+// "tab".
+func parseCsvDelimiter(s string) (rune, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case "tab", "\\t", "\t":
+		return '\t', nil
+	}
+	if utf8.RuneCountInString(s) != 1 {
+		return 0, fmt.Errorf("invalid delimiter: %s", s)
+	}
+	r, _ := utf8.DecodeRuneInString(s)
+	return r, nil
+}
+
+func getCsvDelimiter(path string) rune {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".tsv", ".tab":
+		return '\t'
+	}
+	return ','
+}
+
+func readCsvFile(path string, delimiter rune) ([][]string, error) {
+	input, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = input.Close()
+	}()
+	reader := csv.NewReader(input)
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	if delimiter == '\t' {
+		reader.LazyQuotes = true
+	}
+	return reader.ReadAll()
+}
+
+// selectCsvColumns resolves the columns by the names in the header or by the
+// numbers.
+func selectCsvColumns(s string, header []string, width int) ([]csvColumn, error) {
+	var columns []csvColumn
+	if strings.TrimSpace(s) == "" {
+		for i := 0; i < width; i++ {
+			label := ""
+			if i < len(header) {
+				label = header[i]
+			}
+			columns = append(columns, csvColumn{i, label})
+		}
+		return columns, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		name, label := strings.TrimSpace(field), ""
+		hasLabel := false
+		if i := strings.Index(name, ":"); i >= 0 {
+			name, label, hasLabel = strings.TrimSpace(name[:i]), strings.TrimSpace(name[i+1:]), true
+		}
+		if name == "" {
+			continue
+		}
+		index := -1
+		for i, column := range header {
+			if strings.TrimSpace(column) == name {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			n, err := strconv.Atoi(name)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("unknown column: %s", name)
+			}
+			index = n - 1
+		}
+		if !hasLabel && index < len(header) {
+			label = header[index]
+		}
+		columns = append(columns, csvColumn{index, label})
+	}
+	return columns, nil
+}
+
+func getCsvAlignDelimiter(align string) (string, error) {
+	switch strings.TrimSpace(align) {
+	case "", "none":
+		return "---", nil
+	case "left", "l":
+		return ":---", nil
+	case "center", "c":
+		return ":---:", nil
+	case "right", "r":
+		return "---:", nil
+	}
+	return "", fmt.Errorf("invalid alignment: %s", align)
+}
+
+// writeCsvTable writes the CSV/TSV file as a GFM table.
+func writeCsvTable(writer io.Writer, path string, options *csvOptions, indent string) error {
+	delimiter := options.delimiter
+	if delimiter == 0 {
+		delimiter = getCsvDelimiter(path)
+	}
+	records, err := readCsvFile(path, delimiter)
+	if err != nil {
+		return err
+	}
+	var header []string
+	if options.header && len(records) > 0 {
+		header, records = records[0], records[1:]
+	}
+	width := len(header)
+	for _, record := range records {
+		if len(record) > width {
+			width = len(record)
+		}
+	}
+	columns, err := selectCsvColumns(options.columns, header, width)
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+	var aligns []string
+	if options.align != "" {
+		aligns = strings.Split(options.align, ",")
+	}
+	var labels, delimiters []string
+	for i, column := range columns {
+		labels = append(labels, escapeTableCell(column.label))
+		align := ""
+		if i < len(aligns) {
+			align = aligns[i]
+		} else if len(aligns) > 0 {
+			// The last alignment applies to the rest
+			align = aligns[len(aligns)-1]
+		}
+		d, err := getCsvAlignDelimiter(align)
+		if err != nil {
+			return err
+		}
+		delimiters = append(delimiters, d)
+	}
+	if err := writeTableRow(writer, indent, labels); err != nil {
+		return err
+	}
+	if err := writeTableRow(writer, indent, delimiters); err != nil {
+		return err
+	}
+	for _, record := range records {
+		var cells []string
+		for _, column := range columns {
+			cell := ""
+			if column.index < len(record) {
+				cell = record[column.index]
+			}
+			cells = append(cells, escapeTableCell(cell))
+		}
+		if err := writeTableRow(writer, indent, cells); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeTableRow(writer io.Writer, indent string, cells []string) error {
+	_, err := fmt.Fprintln(writer, indent+"| "+strings.Join(cells, " | ")+" |")
+	return err
+}
@@ -0,0 +1,213 @@
+package mdpp
+
+import (
+	"fmt"
+	"io"
+)
+
+// diffOp is a line of the edit script: ' ' for a common line, '-' for a
+// deleted one and '+' for an inserted one.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// Maximum number of the edits traced by diffLines, beyond which the lines
+// between the common head and tail are replaced as a whole. The trace takes
+// memory in proportion to the square of the number.
+const maxDiffEdits = 2000
+
+// diffLines returns the shortest edit script from a to b by the algorithm of
+// Myers.
+func diffLines(a []string, b []string) []diffOp {
+	// The common lines at the head and the tail need not be traced
+	head := 0
+	for head < len(a) && head < len(b) && a[head] == b[head] {
+		head++
+	}
+	tail := 0
+	for tail < len(a)-head && tail < len(b)-head && a[len(a)-1-tail] == b[len(b)-1-tail] {
+		tail++
+	}
+	var ops []diffOp
+	for _, line := range a[:head] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	ops = append(ops, traceDiff(a[head:len(a)-tail], b[head:len(b)-tail])...)
+	for _, line := range a[len(a)-tail:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// traceDiff returns the shortest edit script by tracing the furthest reaching
+// paths, or the one replacing all the lines if it takes too many edits.
+func traceDiff(a []string, b []string) []diffOp {
+	n, m := len(a), len(b)
+	maxD := n + m
+	if maxD > maxDiffEdits {
+		maxD = maxDiffEdits
+	}
+	offset := maxD + 1
+	v := make([]int, 2*maxD+3)
+	// The states before each round, which hold the diagonals k in [-d, d] at
+	// k+d
+	var trace [][]int
+	found := false
+	for d := 0; d <= maxD && !found; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[k-1+offset] < v[k+1+offset]) {
+				x = v[k+1+offset]
+			} else {
+				x = v[k-1+offset] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k+offset] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	var ops []diffOp
+	if !found {
+		for _, line := range a {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range b {
+			ops = append(ops, diffOp{'+', line})
+		}
+		return ops
+	}
+	// Backtracks from the end with the states before each round
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[k-1+d] < v[k+1+d]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[prevK+d]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			ops = append(ops, diffOp{'+', b[y-1]})
+			y--
+		} else {
+			ops = append(ops, diffOp{'-', a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		ops = append(ops, diffOp{' ', a[x-1]})
+		x--
+		y--
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// formatHunkRange formats the start line and the count as GNU diff does.
+func formatHunkRange(start int, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// writeUnifiedDiff writes the unified diff with the lines of context. Nothing
+// is written if there is no difference.
+func writeUnifiedDiff(writer io.Writer, oldLabel string, newLabel string, a []string, b []string, context int, indent string) error {
+	ops := diffLines(a, b)
+	// Line indexes of a and b before each operation
+	aIndexes, bIndexes := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	var changes []int
+	for i, op := range ops {
+		aIndexes[i+1], bIndexes[i+1] = aIndexes[i], bIndexes[i]
+		if op.kind != '+' {
+			aIndexes[i+1]++
+		}
+		if op.kind != '-' {
+			bIndexes[i+1]++
+		}
+		if op.kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(writer, "%s--- %s\n%s+++ %s\n", indent, oldLabel, indent, newLabel); err != nil {
+		return err
+	}
+	writeHunk := func(start int, end int) error {
+		header := fmt.Sprintf("@@ -%s +%s @@", formatHunkRange(aIndexes[start], aIndexes[end]-aIndexes[start]),
+			formatHunkRange(bIndexes[start], bIndexes[end]-bIndexes[start]))
+		if _, err := fmt.Fprintln(writer, indent+header); err != nil {
+			return err
+		}
+		for _, op := range ops[start:end] {
+			if _, err := fmt.Fprintln(writer, indent+string(op.kind)+op.line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	clamp := func(i int) int {
+		if i < 0 {
+			return 0
+		}
+		if i > len(ops) {
+			return len(ops)
+		}
+		return i
+	}
+	start, end := clamp(changes[0]-context), clamp(changes[0]+1+context)
+	for _, change := range changes[1:] {
+		if change-context > end {
+			if err := writeHunk(start, end); err != nil {
+				return err
+			}
+			start = clamp(change - context)
+		}
+		end = clamp(change + 1 + context)
+	}
+	return writeHunk(start, end)
+}
+
+// writeDiff writes the unified diff between the files at the revisions.
+func writeDiff(writer io.Writer, elem *mdppDiffElem, indent string) error {
+	a, err := readLines(elem.oldPath, elem.oldRev)
+	if err != nil {
+		return err
+	}
+	b, err := readLines(elem.newPath, elem.newRev)
+	if err != nil {
+		return err
+	}
+	label := func(path string, rev string) string {
+		if rev == "" {
+			return path
+		}
+		return rev + ":" + path
+	}
+	return writeUnifiedDiff(writer, label(elem.oldPath, elem.oldRev), label(elem.newPath, elem.newRev), a, b, elem.context, indent)
+}
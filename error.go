@@ -7,6 +7,8 @@ type MdppError struct {
 	absPath  string
 	source   []byte
 	position int
+	// The cause, if any
+	err error
 }
 
 func (me *MdppError) Error() string {
@@ -20,8 +22,17 @@ func (me *MdppError) Error() string {
 	return fmt.Sprintf("%s (%s:%d)", me.msg, me.absPath, lineNo)
 }
 
+func (me *MdppError) Unwrap() error {
+	return me.err
+}
+
 var _ error = (*MdppError)(nil)
 
 func NewError(msg string, absPath string, source []byte, position int) *MdppError {
-	return &MdppError{msg, absPath, source, position}
+	return &MdppError{msg, absPath, source, position, nil}
+}
+
+// wrapError returns the error at the position keeping the cause.
+func wrapError(err error, absPath string, source []byte, position int) *MdppError {
+	return &MdppError{err.Error(), absPath, source, position, err}
 }
@@ -0,0 +1,337 @@
+package mdpp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A small expression language to filter documents by their metadata and to
+// evaluate conditions with variables, e.g. `draft != true && tags contains api`.
+//
+//	expr    := and { ("||" | "or") and }
+//	and     := not { ("&&" | "and") not }
+//	not     := ("!" | "not") not | compare
+//	compare := operand [ ("==" | "!=" | "<" | "<=" | ">" | ">=" | "contains") operand ]
+//	operand := "(" expr ")" | string | number | "true" | "false" | "null" | name
+//
+// Names on the left side of comparisons refer to fields (dotted for nested
+// ones), and bare words on the right side are strings unless they are numbers
+// or keywords. Undefined fields are null.
+
+type lookupFunc func(name string) (interface{}, bool)
+
+type expression interface {
+	evaluate(lookup lookupFunc) interface{}
+}
+
+type literalExpr struct {
+	value interface{}
+}
+
+type fieldExpr struct {
+	name string
+}
+
+type notExpr struct {
+	operand expression
+}
+
+type binaryExpr struct {
+	operator string
+	left     expression
+	right    expression
+}
+
+func (expr *literalExpr) evaluate(lookupFunc) interface{} {
+	return expr.value
+}
+
+func (expr *fieldExpr) evaluate(lookup lookupFunc) interface{} {
+	value, _ := lookup(expr.name)
+	return value
+}
+
+func (expr *notExpr) evaluate(lookup lookupFunc) interface{} {
+	return !isTruthy(expr.operand.evaluate(lookup))
+}
+
+func (expr *binaryExpr) evaluate(lookup lookupFunc) interface{} {
+	left := expr.left.evaluate(lookup)
+	switch expr.operator {
+	case "||":
+		return isTruthy(left) || isTruthy(expr.right.evaluate(lookup))
+	case "&&":
+		return isTruthy(left) && isTruthy(expr.right.evaluate(lookup))
+	}
+	right := expr.right.evaluate(lookup)
+	switch expr.operator {
+	case "==":
+		return equalValues(left, right)
+	case "!=":
+		return !equalValues(left, right)
+	case "contains":
+		return containsValue(left, right)
+	}
+	if left == nil || right == nil {
+		return false
+	}
+	c := compareValues(left, right)
+	switch expr.operator {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+// isTruthy reports whether the value counts as true in conditions.
+func isTruthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != "" && v != "false"
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+	if f, ok := toNumber(value); ok {
+		return f != 0
+	}
+	return true
+}
+
+func equalValues(a interface{}, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if x, ok := toNumber(a); ok {
+		if y, ok := toNumber(b); ok {
+			return x == y
+		}
+	}
+	return metadataString(a) == metadataString(b)
+}
+
+// containsValue reports whether the list has the item, the map has the key,
+// or the string has the substring.
+func containsValue(container interface{}, item interface{}) bool {
+	switch v := container.(type) {
+	case []interface{}:
+		for _, element := range v {
+			if equalValues(element, item) {
+				return true
+			}
+		}
+		return false
+	case map[string]interface{}:
+		_, ok := v[metadataString(item)]
+		return ok
+	case nil:
+		return false
+	}
+	return strings.Contains(metadataString(container), metadataString(item))
+}
+
+type exprToken struct {
+	text string
+	// Quoted strings are not keywords nor names
+	quoted bool
+}
+
+func tokenizeExpression(s string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"' || c == '\'':
+			var text strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				text.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string in expression: %s", s)
+			}
+			tokens = append(tokens, exprToken{text.String(), true})
+			i = j + 1
+		case strings.ContainsRune("()", rune(c)):
+			tokens = append(tokens, exprToken{s[i : i+1], false})
+			i++
+		case strings.ContainsRune("=!<>&|", rune(c)):
+			j := i + 1
+			if j < len(s) && strings.ContainsRune("=&|", rune(s[j])) {
+				j++
+			}
+			op := s[i:j]
+			switch op {
+			case "==", "!=", "<", "<=", ">", ">=", "&&", "||", "!":
+			default:
+				return nil, fmt.Errorf("unknown operator \"%s\" in expression: %s", op, s)
+			}
+			tokens = append(tokens, exprToken{op, false})
+			i = j
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\"'()=!<>&|", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, exprToken{s[i:j], false})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type exprParser struct {
+	source string
+	tokens []exprToken
+	next   int
+}
+
+// parseExpression parses the expression described above.
+func parseExpression(s string) (expression, error) {
+	tokens, err := tokenizeExpression(s)
+	if err != nil {
+		return nil, err
+	}
+	parser := &exprParser{s, tokens, 0}
+	expr, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.next < len(tokens) {
+		return nil, parser.errorf("unexpected \"%s\"", tokens[parser.next].text)
+	}
+	return expr, nil
+}
+
+func (parser *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf(format+" in expression: %s", append(args, parser.source)...)
+}
+
+// accept consumes the next token if it is one of the operators or keywords.
+func (parser *exprParser) accept(operators ...string) (string, bool) {
+	if parser.next >= len(parser.tokens) || parser.tokens[parser.next].quoted {
+		return "", false
+	}
+	text := parser.tokens[parser.next].text
+	for _, operator := range operators {
+		if text == operator {
+			parser.next++
+			return operator, true
+		}
+	}
+	return "", false
+}
+
+func (parser *exprParser) parseOr() (expression, error) {
+	left, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := parser.accept("||", "or"); !ok {
+			return left, nil
+		}
+		right, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{"||", left, right}
+	}
+}
+
+func (parser *exprParser) parseAnd() (expression, error) {
+	left, err := parser.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := parser.accept("&&", "and"); !ok {
+			return left, nil
+		}
+		right, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{"&&", left, right}
+	}
+}
+
+func (parser *exprParser) parseNot() (expression, error) {
+	if _, ok := parser.accept("!", "not"); ok {
+		operand, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{operand}, nil
+	}
+	return parser.parseCompare()
+}
+
+func (parser *exprParser) parseCompare() (expression, error) {
+	left, err := parser.parseOperand(false)
+	if err != nil {
+		return nil, err
+	}
+	operator, ok := parser.accept("==", "!=", "<", "<=", ">", ">=", "contains")
+	if !ok {
+		return left, nil
+	}
+	right, err := parser.parseOperand(true)
+	if err != nil {
+		return nil, err
+	}
+	return &binaryExpr{operator, left, right}, nil
+}
+
+func (parser *exprParser) parseOperand(isRight bool) (expression, error) {
+	if parser.next >= len(parser.tokens) {
+		return nil, parser.errorf("unexpected end")
+	}
+	if _, ok := parser.accept("("); ok {
+		expr, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := parser.accept(")"); !ok {
+			return nil, parser.errorf("\")\" expected")
+		}
+		return expr, nil
+	}
+	token := parser.tokens[parser.next]
+	parser.next++
+	if token.quoted {
+		return &literalExpr{token.text}, nil
+	}
+	switch token.text {
+	case "true":
+		return &literalExpr{true}, nil
+	case "false":
+		return &literalExpr{false}, nil
+	case "null":
+		return &literalExpr{nil}, nil
+	case ")", "==", "!=", "<", "<=", ">", ">=", "&&", "||", "!":
+		return nil, parser.errorf("unexpected \"%s\"", token.text)
+	}
+	if f, err := strconv.ParseFloat(token.text, 64); err == nil {
+		return &literalExpr{f}, nil
+	}
+	if isRight {
+		return &literalExpr{token.text}, nil
+	}
+	return &fieldExpr{token.text}, nil
+}
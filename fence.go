@@ -0,0 +1,199 @@
+package mdpp
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/yuin/goldmark/ast"
+)
+
+// codeFence are the options on the fence of the code block filled by
+// mdppCodeFiller.
+type codeFence struct {
+	// Info string, which is replaced with autoLang if "auto" and kept as
+	// written if empty
+	lang     string
+	autoLang string
+	// Converts an indented code block into a fenced one
+	fenced bool
+}
+
+func newCodeFence(attrs mdppAttributes, autoLang string) (codeFence, error) {
+	fenced, err := attrs.getBool("fence", false)
+	if err != nil {
+		return codeFence{}, err
+	}
+	return codeFence{attrs["lang"], autoLang, fenced}, nil
+}
+
+// info returns the info string to write, or false to keep the written one.
+func (fence *codeFence) info() (string, bool) {
+	switch fence.lang {
+	case "":
+		return "", false
+	case "auto":
+		return fence.autoLang, true
+	}
+	return fence.lang, true
+}
+
+// Info strings by the extensions which differ from the extensions themselves
+var languagesByExtension = map[string]string{
+	".h": "c", ".cc": "cpp", ".cxx": "cpp", ".hpp": "cpp", ".hh": "cpp",
+	".py": "python", ".js": "javascript", ".mjs": "javascript", ".cjs": "javascript",
+	".ts": "typescript", ".rb": "ruby", ".rs": "rust", ".kt": "kotlin", ".kts": "kotlin",
+	".yml": "yaml", ".md": "markdown", ".markdown": "markdown", ".htm": "html",
+	".pl": "perl", ".pm": "perl", ".mk": "makefile", ".patch": "diff",
+	".ps1": "powershell", ".cs": "csharp", ".hs": "haskell", ".tex": "latex",
+	".el": "elisp", ".ex": "elixir", ".exs": "elixir", ".jl": "julia", ".txt": "text",
+}
+
+// Info strings by the file names without extensions
+var languagesByName = map[string]string{
+	"Makefile": "makefile", "GNUmakefile": "makefile", "Dockerfile": "dockerfile",
+	"CMakeLists.txt": "cmake",
+}
+
+// inferLanguage returns the info string by the name or the extension of the
+// file.
+func inferLanguage(path string) string {
+	base := filepath.Base(path)
+	if lang, ok := languagesByName[base]; ok {
+		return lang
+	}
+	extension := strings.ToLower(filepath.Ext(base))
+	if lang, ok := languagesByExtension[extension]; ok {
+		return lang
+	}
+	return strings.TrimPrefix(extension, ".")
+}
+
+// fencedBlock is the location of a fenced code block in the source.
+type fencedBlock struct {
+	// Start of the opening fence line and the end of the block, which is the
+	// end of the closing fence line or of the content if it is not closed
+	start int
+	end   int
+	// Text before the fence in the opening line, such as "> " in block
+	// quotes, and the indent of the other lines
+	prefix string
+	indent string
+	fence  string
+	// The opening and closing lines as written. closing is empty if the block
+	// is not closed.
+	opening string
+	closing string
+}
+
+// lineStart returns the start of the line at the position.
+func lineStart(source []byte, position int) int {
+	return bytes.LastIndexByte(source[:position], '\n') + 1
+}
+
+// lineEnd returns the position after the line terminator of the line at the
+// position.
+func lineEnd(source []byte, position int) int {
+	if i := bytes.IndexByte(source[position:], '\n'); i >= 0 {
+		return position + i + 1
+	}
+	return len(source)
+}
+
+func lineText(source []byte, start int) string {
+	return strings.TrimRight(string(source[start:lineEnd(source, start)]), "\r\n")
+}
+
+// getFencedBlock locates the fenced code block of the node. The opening line
+// is the one with the info string, the one before the content, or the first
+// non-blank one after the previous block if the code block has neither.
+func getFencedBlock(source []byte, node *ast.FencedCodeBlock) (*fencedBlock, bool) {
+	lines := node.Lines()
+	block := &fencedBlock{}
+	infoStart := -1
+	switch {
+	case node.Info != nil:
+		infoStart = node.Info.Segment.Start
+		block.start = lineStart(source, infoStart)
+	case lines.Len() > 0:
+		first := lineStart(source, lines.At(0).Start)
+		if first == 0 {
+			return nil, false
+		}
+		block.start = lineStart(source, first-1)
+	default:
+		previous := node.PreviousSibling()
+		if previous == nil || previous.Lines().Len() == 0 {
+			return nil, false
+		}
+		previousLines := previous.Lines()
+		block.start = lineEnd(source, previousLines.At(previousLines.Len()-1).Start)
+		for block.start < len(source) && strings.Trim(lineText(source, block.start), " \t>") == "" {
+			block.start = lineEnd(source, block.start)
+		}
+	}
+	block.opening = lineText(source, block.start)
+	// The fence is just before the info string or at the end of the line
+	fenceEnd := len(strings.TrimRight(block.opening, " \t"))
+	if infoStart >= 0 {
+		fenceEnd = len(strings.TrimRight(block.opening[:infoStart-block.start], " \t"))
+	}
+	fenceStart := fenceEnd
+	for fenceStart > 0 && (block.opening[fenceStart-1] == '`' || block.opening[fenceStart-1] == '~') &&
+		block.opening[fenceStart-1] == block.opening[fenceEnd-1] {
+		fenceStart--
+	}
+	if fenceEnd-fenceStart < 3 {
+		return nil, false
+	}
+	block.prefix, block.fence = block.opening[:fenceStart], block.opening[fenceStart:fenceEnd]
+	// List markers in the prefix are replaced with spaces in the other lines
+	block.indent = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '>' {
+			return r
+		}
+		return ' '
+	}, block.prefix)
+	block.end = lineEnd(source, block.start)
+	if lines.Len() > 0 {
+		block.end = lineEnd(source, lines.At(lines.Len()-1).Start)
+	}
+	if block.end < len(source) {
+		line := lineText(source, block.end)
+		s := strings.TrimLeft(line, " \t>")
+		n := len(s) - len(strings.TrimLeft(s, block.fence[:1]))
+		if n >= len(block.fence) && strings.TrimSpace(s[n:]) == "" {
+			block.closing = line
+			block.end = lineEnd(source, block.end)
+		}
+	}
+	return block, true
+}
+
+var reFenceLine = regexp.MustCompile("^([ \t>]*)(`{3,}|~{3,})")
+
+// getFence returns the fence made of the character which is long enough not
+// to be closed by the lines of the content.
+func getFence(content []byte, fence string) string {
+	length := len(fence)
+	for _, line := range strings.Split(string(content), "\n") {
+		match := reFenceLine.FindStringSubmatch(line)
+		if match != nil && match[2][0] == fence[0] && len(match[2]) >= length {
+			length = len(match[2]) + 1
+		}
+	}
+	return strings.Repeat(fence[:1], length)
+}
+
+// getContainerIndent returns the indent of the container of the indented code
+// block.
+func getContainerIndent(indent string) string {
+	if strings.HasSuffix(indent, "\t") {
+		return indent[:len(indent)-1]
+	}
+	if strings.HasSuffix(indent, "    ") {
+		return indent[:len(indent)-4]
+	}
+	return ""
+}
@@ -0,0 +1,140 @@
+package mdpp
+
+import (
+	"bufio"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var markdownExtensions = map[string]bool{
+	".md": true, ".markdown": true, ".mdown": true, ".mkd": true, ".mkdn": true,
+	".mdwn": true, ".mdtxt": true, ".mdtext": true, ".mdx": true,
+}
+
+var htmlExtensions = map[string]bool{
+	".html": true, ".htm": true, ".xhtml": true,
+}
+
+// Prefixes of the line comments of source files by the extensions. Block
+// comments are recognized if "/*" is in the list.
+var commentPrefixes = map[string][]string{}
+
+func init() {
+	for _, def := range []struct {
+		extensions string
+		prefixes   []string
+	}{
+		{".c .h .cc .cpp .cxx .hpp .hh .m .java .js .mjs .cjs .jsx .ts .tsx .go .rs .swift .kt .kts .scala .cs .dart .php .groovy", []string{"//", "/*"}},
+		{".css .scss .less", []string{"/*", "//"}},
+		{".sh .bash .zsh .fish .py .rb .pl .pm .r .tcl .ps1 .yaml .yml .toml .mk .cmake .nim .ex .exs .jl .awk", []string{"#"}},
+		{".sql .lua .hs .elm .ada", []string{"--"}},
+		{".lisp .el .clj .scm .ini .asm .s", []string{";"}},
+		{".tex .sty .erl .m4", []string{"%"}},
+		{".vim", []string{"\""}},
+		{".bat .cmd", []string{"REM ", "::"}},
+	} {
+		for _, extension := range strings.Fields(def.extensions) {
+			commentPrefixes[extension] = def.prefixes
+		}
+	}
+}
+
+// IsMarkdownFile reports whether the file is Markdown by its extension.
+func IsMarkdownFile(path string) bool {
+	return markdownExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// GetFileTitle returns the title of the file by its type: the title of a
+// Markdown document, the <title> of an HTML file, or the first comment line of
+// a source file. The path is returned if there is none, and "" if the file
+// cannot be read.
+func GetFileTitle(path string, policy TitlePolicy) string {
+	extension := strings.ToLower(filepath.Ext(path))
+	if markdownExtensions[extension] {
+		return GetMarkdownTitleWithPolicy(path, policy)
+	}
+	input, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer func() {
+		_ = input.Close()
+	}()
+	title := ""
+	if htmlExtensions[extension] {
+		title = getHtmlTitle(input)
+	} else if prefixes, ok := commentPrefixes[extension]; ok {
+		title = getFirstCommentLine(input, prefixes)
+	}
+	if title == "" {
+		return path
+	}
+	return title
+}
+
+var reHtmlTitle = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title\s*>`)
+
+func getHtmlTitle(input io.Reader) string {
+	// The title should be in the head
+	source, err := io.ReadAll(io.LimitReader(input, 64*1024))
+	if err != nil {
+		return ""
+	}
+	match := reHtmlTitle.FindSubmatch(source)
+	if match == nil {
+		return ""
+	}
+	return strings.Join(strings.Fields(html.UnescapeString(string(match[1]))), " ")
+}
+
+// getFirstCommentLine returns the text of the first non-empty comment line at
+// the head of the source, skipping shebang lines and Go build constraints.
+// Nothing is returned if code comes first.
+func getFirstCommentLine(input io.Reader, prefixes []string) string {
+	scanner := bufio.NewScanner(input)
+	inBlock := false
+	for lineNo := 0; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if lineNo == 0 && strings.HasPrefix(line, "#!") {
+			continue
+		}
+		text := ""
+		if inBlock {
+			if i := strings.Index(line, "*/"); i >= 0 {
+				line = line[:i]
+				inBlock = false
+			}
+			text = strings.TrimLeft(line, "*")
+		} else if line == "" || strings.HasPrefix(line, "//go:") || strings.HasPrefix(line, "// +build") {
+			continue
+		} else {
+			isComment := false
+			for _, prefix := range prefixes {
+				if !strings.HasPrefix(line, prefix) {
+					continue
+				}
+				isComment = true
+				text = strings.TrimLeft(line[len(prefix):], prefix[len(prefix)-1:])
+				if prefix == "/*" {
+					if i := strings.Index(text, "*/"); i >= 0 {
+						text = text[:i]
+					} else {
+						inBlock = true
+					}
+				}
+				break
+			}
+			if !isComment {
+				return ""
+			}
+		}
+		if text = strings.TrimSpace(text); text != "" {
+			return text
+		}
+	}
+	return ""
+}
@@ -0,0 +1,95 @@
+package mdpp
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// runGit runs git(1) in the directory and returns the output, or the error
+// with the message of git(1).
+func runGit(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		message := strings.TrimPrefix(strings.TrimSpace(stderr.String()), "fatal: ")
+		if message == "" {
+			message = err.Error()
+		}
+		return nil, fmt.Errorf("%s", message)
+	}
+	return output, nil
+}
+
+// getGitPath returns the top directory of the Git working tree and the
+// slash-separated path of the file relative to it. The file and its
+// directories need not exist in the working tree.
+func getGitPath(path string) (string, string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", "", err
+	}
+	// Git is run in the nearest existing directory
+	dir, rest := filepath.Dir(absPath), filepath.Base(absPath)
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", fmt.Errorf("no directory of %s exists", path)
+		}
+		dir, rest = parent, filepath.Join(filepath.Base(dir), rest)
+	}
+	output, err := runGit(dir, "rev-parse", "--show-toplevel", "--show-prefix")
+	if err != nil {
+		return "", "", err
+	}
+	lines := strings.Split(strings.TrimRight(string(output), "\n"), "\n")
+	prefix := ""
+	if len(lines) > 1 {
+		prefix = lines[1]
+	}
+	return lines[0], prefix + filepath.ToSlash(rest), nil
+}
+
+// checkRevision returns an error if the revision can be taken as an option or
+// a path by git(1).
+func checkRevision(rev string) error {
+	if strings.HasPrefix(rev, "-") || strings.Contains(rev, ":") {
+		return fmt.Errorf("invalid revision: %s", rev)
+	}
+	return nil
+}
+
+// readFileAtRevision reads the file as it exists at the commit, tag or branch
+// of the local Git repository.
+func readFileAtRevision(path string, rev string) ([]byte, error) {
+	if err := checkRevision(rev); err != nil {
+		return nil, err
+	}
+	top, gitPath, err := getGitPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s at %s: %s", path, rev, err.Error())
+	}
+	output, err := runGit(top, "show", rev+":"+gitPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s at %s: %s", path, rev, err.Error())
+	}
+	return output, nil
+}
+
+// readFileContent reads the file at the revision, or in the working tree if
+// the revision is empty.
+func readFileContent(path string, rev string) ([]byte, error) {
+	if rev == "" {
+		return os.ReadFile(path)
+	}
+	return readFileAtRevision(path, rev)
+}
@@ -0,0 +1,184 @@
+package mdpp
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	be "github.com/thomasheller/braceexpansion"
+)
+
+// globOptions are the options for globFiles.
+type globOptions struct {
+	// Patterns of the paths to exclude. A file is excluded also when one of its
+	// parent directories matches.
+	exclude []string
+	// Skips the files and directories whose names start with "."
+	skipHidden bool
+	// Reports whether the path is ignored by the configuration, if not nil
+	ignore func(string) bool
+	// Restricts the files found to the root directory
+	sandbox *sandbox
+}
+
+// expandBraces expands "{a,b}" in the patterns.
+func expandBraces(patterns []string) ([]string, error) {
+	var expanded []string
+	for _, pattern := range patterns {
+		tree, err := be.New().Parse(pattern)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, tree.Expand()...)
+	}
+	return expanded, nil
+}
+
+func hasGlobMeta(segment string) bool {
+	return strings.ContainsAny(segment, `*?[\`)
+}
+
+// globFiles returns the regular files matching the wildcard with braces in
+// slash-separated form. "*", "?" and "[...]" match within a path segment, and
+// "**" matches zero or more directories.
+func globFiles(wildcard string, options *globOptions) ([]string, error) {
+	patterns, err := expandBraces([]string{filepath.ToSlash(wildcard)})
+	if err != nil {
+		return nil, err
+	}
+	excludes, err := expandBraces(options.exclude)
+	if err != nil {
+		return nil, err
+	}
+	for i, exclude := range excludes {
+		excludes[i] = path.Clean(filepath.ToSlash(exclude))
+	}
+	found := map[string]bool{}
+	var paths []string
+	for _, pattern := range patterns {
+		pattern = path.Clean(pattern)
+		segments := strings.Split(pattern, "/")
+		i := 0
+		for i < len(segments)-1 && !hasGlobMeta(segments[i]) {
+			i++
+		}
+		base := strings.Join(segments[:i], "/")
+		if base == "" && strings.HasPrefix(pattern, "/") {
+			base = "/"
+		}
+		if err := options.sandbox.check(base); err != nil {
+			return nil, err
+		}
+		recursive := false
+		for _, segment := range segments {
+			recursive = recursive || segment == "**"
+		}
+		err := walkFiles(base, func(p string, isDir bool) bool {
+			// Directories deeper than the pattern need not to be walked
+			if isDir && !recursive && strings.Count(p, "/")+1 >= len(segments) {
+				return true
+			}
+			if options.ignore != nil && options.ignore(p) {
+				return true
+			}
+			return isExcluded(p, excludes, options.skipHidden, base)
+		}, func(p string) {
+			if !found[p] && matchSegments(segments, strings.Split(p, "/")) {
+				found[p] = true
+				paths = append(paths, p)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Symbolic links can point to the outside
+	for _, p := range paths {
+		if err := options.sandbox.check(p); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// walkFiles calls fn with the slash-separated path of each regular file under
+// the base directory, skipping the paths for which skip returns true.
+func walkFiles(base string, skip func(string, bool) bool, fn func(string)) error {
+	root := base
+	if root == "" {
+		root = "."
+	}
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.WalkDir(root, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		p = filepath.ToSlash(p)
+		if base == "" {
+			p = strings.TrimPrefix(p, "./")
+		}
+		if p != root && skip(p, entry.IsDir()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		if entry.Type()&fs.ModeSymlink != 0 {
+			if info, err := os.Stat(p); err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+		} else if !entry.Type().IsRegular() {
+			return nil
+		}
+		fn(p)
+		return nil
+	})
+}
+
+// isExcluded reports whether the path matches the exclusion patterns, or is
+// hidden below the base. Excluded directories are skipped as a whole.
+func isExcluded(p string, excludes []string, skipHidden bool, base string) bool {
+	if skipHidden {
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, base), "/")
+		for _, name := range strings.Split(rel, "/") {
+			if strings.HasPrefix(name, ".") {
+				return true
+			}
+		}
+	}
+	for _, exclude := range excludes {
+		if matchSegments(strings.Split(exclude, "/"), strings.Split(p, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments matches the path segments against the pattern segments.
+func matchSegments(patterns []string, names []string) bool {
+	if len(patterns) == 0 {
+		return len(names) == 0
+	}
+	if patterns[0] == "**" {
+		for i := 0; i <= len(names); i++ {
+			if matchSegments(patterns[1:], names[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(names) == 0 {
+		return false
+	}
+	if matched, err := path.Match(patterns[0], names[0]); err != nil || !matched {
+		return false
+	}
+	return matchSegments(patterns[1:], names[1:])
+}
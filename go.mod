@@ -3,21 +3,18 @@ module github.com/knaka/mdpp
 go 1.18
 
 require (
+	github.com/BurntSushi/toml v1.2.0
 	github.com/andreyvit/diff v0.0.0-20170406064948-c7f18ee00883
 	github.com/mattn/go-isatty v0.0.13
 	github.com/spf13/pflag v1.0.5
-	github.com/spiegel-im-spiegel/file v0.1.1
 	github.com/thomasheller/braceexpansion v0.0.0-20201129203016-fc18a386c29f
 	github.com/yuin/goldmark v1.4.0
 	github.com/yuin/goldmark-meta v1.0.0
+	gopkg.in/yaml.v2 v2.3.0
 )
 
 require (
-	github.com/saracen/walker v0.0.0-20191020095038-4d832ad28155 // indirect
 	github.com/sergi/go-diff v1.2.0 // indirect
-	github.com/spiegel-im-spiegel/errs v0.3.2 // indirect
 	github.com/thomasheller/slicecmp v0.0.0-20191029144834-595e9211ce09 // indirect
-	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e // indirect
 	golang.org/x/sys v0.0.0-20220915200043-7b5979e65e41 // indirect
-	gopkg.in/yaml.v2 v2.3.0 // indirect
 )
@@ -0,0 +1,545 @@
+package mdpp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// indexEntry is a file listed in an index.
+type indexEntry struct {
+	// Slash-separated path relative to the including document
+	path     string
+	title    string
+	metadata Metadata
+	modTime  time.Time
+	// The file is the including document itself
+	isSelf bool
+}
+
+func (entry *indexEntry) markdown() string {
+	if entry.isSelf {
+		return entry.title
+	}
+	return "[" + entry.title + "](" + entry.path + ")"
+}
+
+// indexNode is a directory or a file in the tree of an index.
+type indexNode struct {
+	// The last element of the path of the directory
+	name string
+	// The file, or the README of the directory
+	entry    *indexEntry
+	children []*indexNode
+}
+
+func (node *indexNode) isDir() bool {
+	return node.children != nil
+}
+
+func (node *indexNode) getDir(name string) *indexNode {
+	for _, child := range node.children {
+		if child.isDir() && child.name == name {
+			return child
+		}
+	}
+	child := &indexNode{name: name, children: []*indexNode{}}
+	node.children = append(node.children, child)
+	return child
+}
+
+// lookup returns the metadata field, or the path or title of the entry.
+func (entry *indexEntry) lookup(name string) (interface{}, bool) {
+	if value, ok := entry.metadata.Lookup(name); ok {
+		return value, true
+	}
+	switch name {
+	case "path":
+		return entry.path, true
+	case "title":
+		return entry.title, true
+	}
+	return nil, false
+}
+
+// filterIndexEntries returns the entries for which the condition holds.
+func filterIndexEntries(entries []*indexEntry, where expression) []*indexEntry {
+	var filtered []*indexEntry
+	for _, entry := range entries {
+		if isTruthy(where.evaluate(entry.lookup)) {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
+
+// Names of the files which give the titles of directories
+var dirIndexNames = []string{"README.md", "index.md"}
+
+func newIndexEntry(p string, includerPath string, titlePolicy TitlePolicy) (*indexEntry, error) {
+	title := GetFileTitle(p, titlePolicy)
+	if title == p || title == "" {
+		title = path.Base(p)
+	}
+	metadata := Metadata{}
+	if IsMarkdownFile(p) {
+		if m, _, err := GetMarkdownMetadata(p); err == nil {
+			metadata = m
+		}
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	absPath, err := filepath.Abs(p)
+	if err != nil {
+		return nil, err
+	}
+	return &indexEntry{p, title, metadata, info.ModTime(), absPath == includerPath}, nil
+}
+
+// sortIndexEntries sorts the entries stably by the key, which is "path",
+// "natural" (path in natural order), "title", "mtime" or a metadata field.
+// Entries without the field come last.
+func sortIndexEntries(entries []*indexEntry, key string, reverse bool) {
+	compare := func(a *indexEntry, b *indexEntry) int {
+		switch key {
+		case "", "path":
+			return strings.Compare(a.path, b.path)
+		case "natural":
+			return compareNatural(a.path, b.path)
+		case "title":
+			return compareNatural(strings.ToLower(a.title), strings.ToLower(b.title))
+		case "mtime":
+			return compareValues(a.modTime, b.modTime)
+		}
+		x, _ := a.metadata.Lookup(key)
+		y, _ := b.metadata.Lookup(key)
+		return compareValues(x, y)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if !isBuiltinSortKey(key) {
+			_, okA := a.metadata.Lookup(key)
+			_, okB := b.metadata.Lookup(key)
+			if okA != okB {
+				return okA
+			}
+			if !okA {
+				return false
+			}
+		}
+		c := compare(a, b)
+		if reverse {
+			return c > 0
+		}
+		return c < 0
+	})
+}
+
+func isBuiltinSortKey(key string) bool {
+	switch key {
+	case "", "path", "natural", "title", "mtime":
+		return true
+	}
+	return false
+}
+
+func collectIndexEntries(elem *mdppIndexElem, includerPath string, titlePolicy TitlePolicy) ([]*indexEntry, error) {
+	paths, err := globFiles(elem.pattern, &elem.globOptions)
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range paths {
+		if !strings.ContainsRune(p, '/') {
+			paths[i] = "./" + p
+		}
+	}
+	sort.Strings(paths)
+	var entries []*indexEntry
+	for _, p := range paths {
+		entry, err := newIndexEntry(p, includerPath, titlePolicy)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// buildIndexTree builds the directory tree of the entries keeping their order.
+func buildIndexTree(entries []*indexEntry) *indexNode {
+	root := &indexNode{children: []*indexNode{}}
+	for _, entry := range entries {
+		node := root
+		if dir := path.Dir(entry.path); dir != "." {
+			names := strings.Split(dir, "/")
+			if names[0] == "" {
+				names = append([]string{"/" + names[1]}, names[2:]...)
+			}
+			for _, name := range names {
+				node = node.getDir(name)
+			}
+		}
+		node.children = append(node.children, &indexNode{name: path.Base(entry.path), entry: entry})
+	}
+	return root
+}
+
+// setDirTitles labels the directories with their README.md or index.md, which
+// are removed from the children.
+func setDirTitles(node *indexNode, dir string, includerPath string, titlePolicy TitlePolicy, sb *sandbox) error {
+	for _, child := range node.children {
+		if !child.isDir() {
+			continue
+		}
+		childDir := path.Join(dir, child.name)
+		for _, name := range dirIndexNames {
+			p := path.Join(childDir, name)
+			if info, err := os.Stat(p); err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			// It can be a symbolic link to the outside
+			if err := sb.check(p); err != nil {
+				return err
+			}
+			entry, err := newIndexEntry(p, includerPath, titlePolicy)
+			if err != nil {
+				return err
+			}
+			if entry.title == name {
+				entry.title = child.name
+			}
+			child.entry = entry
+			var children []*indexNode
+			for _, grandchild := range child.children {
+				if grandchild.isDir() || path.Clean(grandchild.entry.path) != p {
+					children = append(children, grandchild)
+				}
+			}
+			child.children = children
+			break
+		}
+		if err := setDirTitles(child, childDir, includerPath, titlePolicy, sb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeIndexTree writes the nodes as nested lists down to the depth if it is
+// positive.
+func writeIndexTree(writer io.Writer, node *indexNode, indent string, level int, depth int) error {
+	for _, child := range node.children {
+		label := child.name
+		if child.entry != nil {
+			label = child.entry.markdown()
+		}
+		if _, err := fmt.Fprintln(writer, indent+strings.Repeat("  ", level)+"* "+label); err != nil {
+			return err
+		}
+		if child.isDir() && (depth <= 0 || level+1 < depth) {
+			if err := writeIndexTree(writer, child, indent, level+1, depth); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeIndexList writes the entries as a flat bulleted or numbered list.
+func writeIndexList(writer io.Writer, entries []*indexEntry, indent string, numbered bool) error {
+	for i, entry := range entries {
+		marker := "* "
+		if numbered {
+			marker = fmt.Sprintf("%d. ", i+1)
+		}
+		if _, err := fmt.Fprintln(writer, indent+marker+entry.markdown()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexColumn is a column of the table layout. Its name is "title", "path" or
+// a metadata field.
+type indexColumn struct {
+	name  string
+	label string
+}
+
+// parseIndexColumns parses comma-separated column names optionally followed
+// by ":" and a label, such as "title,date:Published".
+func parseIndexColumns(s string) ([]indexColumn, error) {
+	var columns []indexColumn
+	for _, field := range strings.Split(s, ",") {
+		name, label := strings.TrimSpace(field), ""
+		if i := strings.Index(name, ":"); i >= 0 {
+			name, label = strings.TrimSpace(name[:i]), strings.TrimSpace(name[i+1:])
+		}
+		if name == "" {
+			continue
+		}
+		if label == "" {
+			r, size := utf8.DecodeRuneInString(name)
+			label = strings.ToUpper(string(r)) + name[size:]
+		}
+		columns = append(columns, indexColumn{name, label})
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no columns: %q", s)
+	}
+	return columns, nil
+}
+
+// escapeTableCell escapes the text to be put in a cell of a GFM table.
+func escapeTableCell(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	return strings.ReplaceAll(s, "|", "\\|")
+}
+
+func writeIndexTable(writer io.Writer, entries []*indexEntry, indent string, columns []indexColumn) error {
+	var header, delimiter []string
+	for _, column := range columns {
+		header = append(header, escapeTableCell(column.label))
+		delimiter = append(delimiter, "---")
+	}
+	if _, err := fmt.Fprintln(writer, indent+"| "+strings.Join(header, " | ")+" |"); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(writer, indent+"| "+strings.Join(delimiter, " | ")+" |"); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		var cells []string
+		for _, column := range columns {
+			var cell string
+			switch column.name {
+			case "title":
+				cell = entry.markdown()
+			case "path":
+				cell = entry.path
+			default:
+				cell, _ = entry.metadata.GetString(column.name)
+			}
+			cells = append(cells, escapeTableCell(cell))
+		}
+		if _, err := fmt.Fprintln(writer, indent+"| "+strings.Join(cells, " | ")+" |"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeIndexDefinitions writes the entries as a definition list of Pandoc and
+// PHP Markdown Extra with the descriptions in the field.
+func writeIndexDefinitions(writer io.Writer, entries []*indexEntry, indent string, field string) error {
+	for i, entry := range entries {
+		if i > 0 {
+			if _, err := fmt.Fprintln(writer, strings.TrimRight(indent, " \t")); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(writer, indent+entry.markdown()); err != nil {
+			return err
+		}
+		if description, ok := entry.metadata.GetString(field); ok && description != "" {
+			description = strings.Join(strings.Fields(description), " ")
+			if _, err := fmt.Fprintln(writer, indent+":   "+description); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexGroup is a section of an index grouped by a metadata field.
+type indexGroup struct {
+	label   string
+	entries []*indexEntry
+}
+
+var reYear = regexp.MustCompile(`^\d{4}(-\d{2})?`)
+
+// getGroupLabels returns the labels of the groups the entry belongs to. The
+// field can be followed by ":year" or ":month" to group dates.
+func getGroupLabels(entry *indexEntry, field string) []string {
+	field, unit := field, ""
+	if i := strings.LastIndex(field, ":"); i >= 0 {
+		field, unit = field[:i], field[i+1:]
+	}
+	value, ok := entry.metadata.Lookup(field)
+	if !ok {
+		return nil
+	}
+	var values []interface{}
+	if list, ok := value.([]interface{}); ok {
+		values = list
+	} else {
+		values = []interface{}{value}
+	}
+	var labels []string
+	for _, value := range values {
+		label := metadataString(value)
+		if unit == "year" || unit == "month" {
+			label = reYear.FindString(label)
+			if unit == "year" && len(label) > 4 {
+				label = label[:4]
+			}
+		}
+		if label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// groupIndexEntries groups the entries keeping their order. An entry is put
+// in each group of the values if the field is a list, and entries without the
+// field are put in the last group labeled otherLabel.
+func groupIndexEntries(entries []*indexEntry, field string, order string, otherLabel string) []*indexGroup {
+	var groups []*indexGroup
+	groupMap := map[string]*indexGroup{}
+	others := &indexGroup{label: otherLabel}
+	for _, entry := range entries {
+		labels := getGroupLabels(entry, field)
+		if len(labels) == 0 {
+			others.entries = append(others.entries, entry)
+		}
+		for _, label := range labels {
+			group, ok := groupMap[label]
+			if !ok {
+				group = &indexGroup{label: label}
+				groupMap[label] = group
+				groups = append(groups, group)
+			}
+			group.entries = append(group.entries, entry)
+		}
+	}
+	if order != "first" {
+		sort.SliceStable(groups, func(i, j int) bool {
+			c := compareNatural(groups[i].label, groups[j].label)
+			if order == "desc" {
+				return c > 0
+			}
+			return c < 0
+		})
+	}
+	if len(others.entries) > 0 {
+		groups = append(groups, others)
+	}
+	return groups
+}
+
+// writeIndexEntries writes the entries in the layout.
+func writeIndexEntries(writer io.Writer, elem *mdppIndexElem, entries []*indexEntry, indent string,
+	includerPath string, titlePolicy TitlePolicy) error {
+	switch elem.layout {
+	case "flat", "numbered":
+		return writeIndexList(writer, entries, indent, elem.layout == "numbered")
+	case "table":
+		return writeIndexTable(writer, entries, indent, elem.columns)
+	case "definition":
+		return writeIndexDefinitions(writer, entries, indent, elem.descriptionField)
+	}
+	root := buildIndexTree(entries)
+	if elem.dirTitle {
+		if err := setDirTitles(root, "", includerPath, titlePolicy, elem.sandbox); err != nil {
+			return err
+		}
+	}
+	return writeIndexTree(writer, root, indent, 0, elem.depth)
+}
+
+// Write index to io.Writer with indent
+func writeIndex(writer io.Writer, elem *mdppIndexElem, indent string, includerPath string, titlePolicy TitlePolicy) error {
+	includerPath, err := filepath.EvalSymlinks(includerPath)
+	if err != nil {
+		return err
+	}
+	entries, err := collectIndexEntries(elem, includerPath, titlePolicy)
+	if err != nil {
+		return err
+	}
+	return writeIndexOf(writer, elem, entries, indent, includerPath, titlePolicy)
+}
+
+// writeIndexOf filters, sorts and limits the entries, and writes them.
+func writeIndexOf(writer io.Writer, elem *mdppIndexElem, entries []*indexEntry, indent string,
+	includerPath string, titlePolicy TitlePolicy) error {
+	if elem.where != nil {
+		entries = filterIndexEntries(entries, elem.where)
+	}
+	sortIndexEntries(entries, elem.sortKey, elem.reverse)
+	total := len(entries)
+	entries = limitIndexEntries(entries, elem.offset, elem.limit)
+	if err := writeIndexGroups(writer, elem, entries, indent, includerPath, titlePolicy); err != nil {
+		return err
+	}
+	if elem.more == "" || elem.offset+len(entries) >= total {
+		return nil
+	}
+	more := "[" + elem.moreLabel + "](" + elem.more + ")"
+	switch {
+	case elem.layout == "table" || elem.layout == "definition" || elem.groupHeading > 0:
+		more = strings.TrimRight(indent, " \t") + "\n" + indent + more
+	case elem.layout == "numbered" && elem.group == "":
+		more = indent + fmt.Sprintf("%d. ", len(entries)+1) + more
+	default:
+		more = indent + "* " + more
+	}
+	_, err := fmt.Fprintln(writer, more)
+	return err
+}
+
+// limitIndexEntries skips the entries by the offset and returns up to limit
+// entries if it is positive.
+func limitIndexEntries(entries []*indexEntry, offset int, limit int) []*indexEntry {
+	if offset >= len(entries) {
+		return nil
+	}
+	entries = entries[offset:]
+	if limit > 0 && limit < len(entries) {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+func writeIndexGroups(writer io.Writer, elem *mdppIndexElem, entries []*indexEntry, indent string,
+	includerPath string, titlePolicy TitlePolicy) error {
+	if elem.group == "" {
+		return writeIndexEntries(writer, elem, entries, indent, includerPath, titlePolicy)
+	}
+	blankLine := strings.TrimRight(indent, " \t")
+	for i, group := range groupIndexEntries(entries, elem.group, elem.groupOrder, elem.groupOther) {
+		if elem.groupHeading > 0 {
+			if i > 0 {
+				if _, err := fmt.Fprintln(writer, blankLine); err != nil {
+					return err
+				}
+			}
+			heading := strings.Repeat("#", elem.groupHeading) + " " + group.label
+			if _, err := fmt.Fprintln(writer, indent+heading+"\n"+blankLine); err != nil {
+				return err
+			}
+			if err := writeIndexEntries(writer, elem, group.entries, indent, includerPath, titlePolicy); err != nil {
+				return err
+			}
+		} else {
+			if _, err := fmt.Fprintln(writer, indent+"* "+group.label); err != nil {
+				return err
+			}
+			if err := writeIndexEntries(writer, elem, group.entries, indent+"  ", includerPath, titlePolicy); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -9,11 +9,8 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
-	"sort"
 	"strings"
 
-	fileex "github.com/spiegel-im-spiegel/file"
-	be "github.com/thomasheller/braceexpansion"
 	"github.com/yuin/goldmark"
 	meta "github.com/yuin/goldmark-meta"
 	"github.com/yuin/goldmark/ast"
@@ -21,82 +18,93 @@ import (
 	mtext "github.com/yuin/goldmark/text"
 )
 
-// Write index to io.Writer with indent
-func writeIndex(writer io.Writer, wildcard string, indent string, includerPath string) error {
-	includerPath, err := filepath.EvalSymlinks(includerPath)
-	if err != nil {
-		return err
-	}
-	// paths, err := fileex.Glob(wildcard)
-	tree, err := be.New().Parse(wildcard)
-	if err != nil {
-		return err
-	}
-	var paths []string
-	for _, pattern := range tree.Expand() {
-		pathsNew, err := fileex.Glob(pattern)
-		if err != nil {
-			return err
-		}
-		paths = append(paths, pathsNew...)
-	}
-	if err != nil {
-		return err
+// codeOptions are the options of the lines of the embedded file.
+type codeOptions struct {
+	// Strips the leading whitespace common to the non-blank lines
+	dedent bool
+	// Expands tabs to the columns of the width if positive
+	tabWidth int
+	// Does not indent empty lines, which would have trailing whitespace
+	trim bool
+	// Revision of Git to read the file at, if not empty
+	rev string
+}
+
+// expandTabs replaces the tabs with spaces up to the next tab stops.
+func expandTabs(s string, tabWidth int) string {
+	if tabWidth <= 0 || !strings.Contains(s, "\t") {
+		return s
 	}
-	for i, path := range paths {
-		if !strings.ContainsRune(path, '/') {
-			paths[i] = "./" + path
+	var builder strings.Builder
+	column := 0
+	for _, r := range s {
+		if r == '\t' {
+			n := tabWidth - column%tabWidth
+			builder.WriteString(strings.Repeat(" ", n))
+			column += n
+			continue
 		}
+		builder.WriteRune(r)
+		column++
 	}
-	sort.Strings(paths)
-	dirnamePrev := ""
-	dirIndent := ""
-	for _, path := range paths {
-		if filepath.Separator != '/' {
-			path = filepath.ToSlash(path)
-		}
-		title := GetMarkdownTitle(path)
-		dirname := filepath.Dir(path)
-		if filepath.Separator != '/' {
-			dirname = filepath.ToSlash(dirname)
-		}
-		if dirname != "." && dirname != dirnamePrev {
-			if _, err := fmt.Fprintln(writer, indent+"* "+dirname); err != nil {
-				return err
-			}
-			dirIndent = "  "
-		}
-		if path == title {
-			title = filepath.Base(path)
+	return builder.String()
+}
+
+// dedentCode strips the leading whitespace common to the non-blank lines.
+func dedentCode(lines []string) []string {
+	prefix := ""
+	first := true
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
 		}
-		dirnamePrev = dirname
-		s := title
-		if a, err := filepath.Abs(path); err != nil {
-			return err
-		} else if a != includerPath {
-			s = "[" + title + "](" + path + ")"
+		leading := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if first {
+			prefix, first = leading, false
+			continue
 		}
-		if _, err := fmt.Fprintln(writer, indent+dirIndent+"* "+s); err != nil {
-			return err
+		i := 0
+		for i < len(prefix) && i < len(leading) && prefix[i] == leading[i] {
+			i++
 		}
+		prefix = prefix[:i]
 	}
-	return nil
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(line, prefix)
+	}
+	return lines
 }
 
-func writeFileWithIndent(writer io.Writer, pathForCodeBlock string, indent string) (errReturn error) {
-	blockInput, err := os.Open(pathForCodeBlock)
+// readLines reads the lines of the file at the revision.
+func readLines(path string, rev string) ([]string, error) {
+	content, err := readFileContent(path, rev)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+func writeFileWithIndent(writer io.Writer, pathForCodeBlock string, indent string, options *codeOptions) error {
+	lines, err := readLines(pathForCodeBlock, options.rev)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := blockInput.Close(); err != nil {
-			errReturn = err
+	for i, line := range lines {
+		lines[i] = expandTabs(line, options.tabWidth)
+	}
+	if options.dedent {
+		lines = dedentCode(lines)
+	}
+	for _, s := range lines {
+		if s != "" || !options.trim {
+			s = indent + s
 		}
-	}()
-	scannerBlockInput := bufio.NewScanner(blockInput)
-	for scannerBlockInput.Scan() {
-		s := scannerBlockInput.Text()
-		if _, err := fmt.Fprintln(writer, indent+s); err != nil {
+		if _, err := fmt.Fprintln(writer, s); err != nil {
 			return err
 		}
 	}
@@ -124,9 +132,53 @@ func writeStrBeforeSegmentsStop(writer io.Writer, source []byte,
 	return lastSegment.Stop, nil
 }
 
-const strReBegin = `<!-- *(mdpp[_a-zA-Z0-9]*)( ([_a-zA-Z][_a-zA-Z0-9]*)=([^ ]*))? *-->`
+const strReBegin = `<!-- *(mdpp[_a-zA-Z0-9]*)((?: +[_a-zA-Z][-_a-zA-Z0-9]*=(?:"[^"]*"|'[^']*'|[^ "']*))*) *-->`
+const strReAttribute = `([_a-zA-Z][-_a-zA-Z0-9]*)=("[^"]*"|'[^']*'|[^ "']*)`
 const strReEnd = `<!-- /(mdpp[_a-zA-Z0-9]*) -->`
 
+// parseAttributes parses the attributes matched with strReBegin. Values can be
+// quoted with '"' or "'" to contain spaces.
+func parseAttributes(reAttribute *regexp.Regexp, s string) mdppAttributes {
+	attrs := mdppAttributes{}
+	for _, match := range reAttribute.FindAllStringSubmatch(s, -1) {
+		value := match[2]
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+			value = value[1 : len(value)-1]
+		}
+		attrs[match[1]] = value
+	}
+	return attrs
+}
+
+// Options are the settings of the preprocessing. The zero value is the default.
+type Options struct {
+	TitlePolicy TitlePolicy
+	// Variables given on the command line, which precede the ones in the
+	// front matter of the document and in the configuration
+	Variables map[string]string
+	// The project configuration, if any
+	Config *Config
+	// Root directory out of which no file is read, if not empty
+	Root string
+	// Allows custom directives to execute their commands. Configurations found
+	// from the documents cannot allow it by themselves.
+	AllowExec bool
+}
+
+// lookupVariable returns the value of the variable.
+func (options *Options) lookupVariable(name string, documentMetadata Metadata) (interface{}, bool) {
+	if value, ok := options.Variables[name]; ok {
+		return value, true
+	}
+	if value, ok := documentMetadata.Lookup(name); ok {
+		return value, true
+	}
+	if options.Config != nil {
+		return options.Config.Variables.Lookup(name)
+	}
+	return nil, false
+}
+
 func PreprocessWithoutDir(writer io.Writer, reader io.Reader) error {
 	_, _, err := Preprocess(writer, reader, "", "")
 	return err
@@ -134,6 +186,18 @@ func PreprocessWithoutDir(writer io.Writer, reader io.Reader) error {
 
 func Preprocess(writerOut io.Writer, reader io.Reader,
 	workDir string, inPath string) (foundMdppDirective bool, changed bool, errReturn error) {
+	return PreprocessWithOptions(writerOut, reader, workDir, inPath, &Options{})
+}
+
+func PreprocessWithOptions(writerOut io.Writer, reader io.Reader,
+	workDir string, inPath string, options *Options) (foundMdppDirective bool, changed bool, errReturn error) {
+	return preprocess(writerOut, reader, workDir, inPath, options, nil)
+}
+
+// preprocess preprocesses the input with the metadata of the document, which
+// is read from the input if nil.
+func preprocess(writerOut io.Writer, reader io.Reader,
+	workDir string, inPath string, options *Options, documentMetadata Metadata) (foundMdppDirective bool, changed bool, errReturn error) {
 	foundMdppDirective = false
 	changed = false
 	dirSaved, err := os.Getwd()
@@ -157,6 +221,37 @@ func Preprocess(writerOut io.Writer, reader io.Reader,
 		return foundMdppDirective, changed, err
 	}
 	source := readBuffer.Bytes()
+	sb, err := newSandbox(options.Root)
+	if err != nil {
+		return foundMdppDirective, changed, err
+	}
+	// checkPaths returns the error at the position if any of the paths escapes
+	// the root.
+	checkPaths := func(position int, paths ...string) error {
+		for _, p := range paths {
+			if p == "" {
+				continue
+			}
+			if err := sb.check(p); err != nil {
+				return wrapError(err, absPath, source, position)
+			}
+		}
+		return nil
+	}
+	// Read lazily as only mdppvar and mdppif need it
+	getDocumentMetadata := func() (Metadata, error) {
+		if documentMetadata == nil {
+			var err error
+			if documentMetadata, _, err = GetMarkdownMetadataSub(bytes.NewReader(source)); err != nil {
+				return nil, err
+			}
+		}
+		return documentMetadata, nil
+	}
+	lookupVariable := func(name string) (interface{}, bool) {
+		metadata, _ := getDocumentMetadata()
+		return options.lookupVariable(name, metadata)
+	}
 	writer := bytes.NewBuffer(nil)
 	// Position on source
 	position := 0
@@ -167,12 +262,63 @@ func Preprocess(writerOut io.Writer, reader io.Reader,
 	// RE objects are allocated locally to avoid lock among threads
 	var reBegin *regexp.Regexp = nil
 	var reEnd *regexp.Regexp = nil
+	var reAttribute *regexp.Regexp = nil
+	matchBegin := func(text string) ([]string, mdppAttributes) {
+		if reBegin == nil {
+			reBegin = regexp.MustCompile(strReBegin)
+			reAttribute = regexp.MustCompile(strReAttribute)
+		}
+		match := reBegin.FindStringSubmatch(text)
+		if match == nil {
+			return nil, nil
+		}
+		attrs := parseAttributes(reAttribute, match[2])
+		options.Config.applyDefaults(match[1], attrs)
+		return match, attrs
+	}
+	// mdppif whose disabled branch is being read, and the number of the
+	// mdppif opened in it
+	var skipping *mdppIfElem
+	skippedIfs := 0
+	// skipNode reports whether the node is in the disabled branch, where
+	// directives are not run but copied as they are. The mdppelse and the
+	// closing comment of the mdppif are not skipped.
+	skipNode := func(node ast.Node) bool {
+		htmlBlock, ok := node.(*ast.HTMLBlock)
+		if !ok || htmlBlock.HTMLBlockType != ast.HTMLBlockType2 {
+			return true
+		}
+		firstLine := node.Lines().At(0)
+		txt := string(source[firstLine.Start:firstLine.Stop])
+		if match, _ := matchBegin(txt); match != nil {
+			switch match[1] {
+			case "mdppif":
+				skippedIfs++
+			case "mdppelse":
+				return skippedIfs > 0
+			}
+			return true
+		}
+		if reEnd == nil {
+			reEnd = regexp.MustCompile(strReEnd)
+		}
+		if match := reEnd.FindStringSubmatch(txt); match != nil && match[1] == "mdppif" {
+			if skippedIfs == 0 {
+				return false
+			}
+			skippedIfs--
+		}
+		return true
+	}
 	walker := func(node ast.Node, entering bool) (ast.WalkStatus, error) {
 		if !entering {
 			location = location[:len(location)-1]
 			return ast.WalkContinue, nil
 		}
 		location = append(location, &node)
+		if skipping != nil && skipNode(node) {
+			return ast.WalkContinue, nil
+		}
 		switch node.Kind() {
 		case ast.KindRawHTML:
 			rawHtml, ok := node.(*ast.RawHTML)
@@ -184,21 +330,26 @@ func Preprocess(writerOut io.Writer, reader io.Reader,
 			text := string(source[segment.Start:segment.Stop])
 			if strings.HasPrefix(text, "<!-- mdpp") {
 				foundMdppDirective = true
-				if reBegin == nil {
-					reBegin = regexp.MustCompile(strReBegin)
-				}
-				match := reBegin.FindStringSubmatch(text)
+				match, attrs := matchBegin(text)
 				if match == nil {
 					return ast.WalkStop, NewError("could not match regexp", absPath, source, segment.Start)
 				}
 				command := match[1]
 				baseElem := mdppElem{len(location)}
-				if command == "mdpplink" {
-					key := match[3]
-					if key == "href" {
-						value := match[4]
-						mdppStack = append(mdppStack, &mdppLinkElem{baseElem, value})
+				switch command {
+				case "mdpplink":
+					if href, ok := attrs["href"]; ok {
+						if err := checkPaths(segment.Start, href); err != nil {
+							return ast.WalkStop, err
+						}
+						mdppStack = append(mdppStack, &mdppLinkElem{baseElem, href})
 					}
+				case "mdppvar":
+					name, ok := attrs["name"]
+					if !ok {
+						return ast.WalkStop, NewError("attribute \"name\" required", absPath, source, segment.Start)
+					}
+					mdppStack = append(mdppStack, &mdppVarElem{baseElem, name})
 				}
 			} else if strings.HasPrefix(text, "<!-- /mdpp") {
 				if reEnd == nil {
@@ -212,17 +363,34 @@ func Preprocess(writerOut io.Writer, reader io.Reader,
 				if mdppStack[len(mdppStack)-1].Name() != command {
 					return ast.WalkStop, NewError("unbalanced closing command", absPath, source, segment.Start)
 				}
-				if command == "mdpplink" {
+				switch command {
+				case "mdpplink":
 					elem, ok := mdppStack[len(mdppStack)-1].(*mdppLinkElem)
 					if !ok {
 						return ast.WalkStop, NewError("failed to downcast mdpplink", absPath, source, segment.Start)
 					}
 					mdppStack = mdppStack[:len(mdppStack)-1]
-					title := GetMarkdownTitle(elem.href)
+					title := GetFileTitle(elem.href, options.TitlePolicy)
 					modified := "[" + title + "](" + elem.href + ")"
 					if _, err := fmt.Fprint(writer, modified); err != nil {
 						return ast.WalkStop, err
 					}
+				case "mdppvar":
+					elem, ok := mdppStack[len(mdppStack)-1].(*mdppVarElem)
+					if !ok {
+						return ast.WalkStop, NewError("failed to downcast mdppvar", absPath, source, segment.Start)
+					}
+					mdppStack = mdppStack[:len(mdppStack)-1]
+					if _, err := getDocumentMetadata(); err != nil {
+						return ast.WalkStop, err
+					}
+					value, ok := lookupVariable(elem.name)
+					if !ok {
+						return ast.WalkStop, NewError("undefined variable: "+elem.name, absPath, source, segment.Start)
+					}
+					if _, err := fmt.Fprint(writer, metadataString(value)); err != nil {
+						return ast.WalkStop, err
+					}
 				}
 				position = segment.Start
 			}
@@ -241,30 +409,130 @@ func Preprocess(writerOut io.Writer, reader io.Reader,
 			segments := node.Lines()
 			firstLine := segments.At(0)
 			txt := string(source[firstLine.Start:firstLine.Stop])
+			if strings.HasPrefix(txt, disabledBegin) {
+				// A branch disabled by mdppif
+				break
+			}
 			if strings.HasPrefix(txt, "<!-- mdpp") {
-				if reBegin == nil {
-					reBegin = regexp.MustCompile(strReBegin)
+				match, attrs := matchBegin(txt)
+				if match == nil {
+					return ast.WalkStop, NewError("could not match regexp", absPath, source, firstLine.Start)
 				}
-				match := reBegin.FindStringSubmatch(txt)
 				command := match[1]
 				mdppElem := mdppElem{len(location)}
 				switch command {
 				case "mdppcode":
-					key := match[3]
-					if key == "src" {
-						mdppStack = append(mdppStack, &mdppCodeElem{mdppElem, match[4]})
-					} else {
-						return ast.WalkStop, NewError("attribute \"src\" required", absPath, source, firstLine.Start)
+					elem, err := newMdppCodeElem(mdppElem, attrs)
+					if err != nil {
+						return ast.WalkStop, NewError(err.Error(), absPath, source, firstLine.Start)
+					}
+					if err := checkPaths(firstLine.Start, elem.filepath); err != nil {
+						return ast.WalkStop, err
+					}
+					mdppStack = append(mdppStack, elem)
+				case "mdppdiff":
+					elem, err := newMdppDiffElem(mdppElem, attrs)
+					if err != nil {
+						return ast.WalkStop, NewError(err.Error(), absPath, source, firstLine.Start)
+					}
+					if err := checkPaths(firstLine.Start, elem.oldPath, elem.newPath); err != nil {
+						return ast.WalkStop, err
+					}
+					mdppStack = append(mdppStack, elem)
+				case "mdpptree":
+					elem, err := newMdppTreeElem(mdppElem, attrs)
+					if err != nil {
+						return ast.WalkStop, NewError(err.Error(), absPath, source, firstLine.Start)
+					}
+					if err := checkPaths(firstLine.Start, elem.dir, elem.comments); err != nil {
+						return ast.WalkStop, err
+					}
+					mdppStack = append(mdppStack, elem)
+				case "mdppcsv":
+					elem, err := newMdppCsvElem(mdppElem, attrs)
+					if err != nil {
+						return ast.WalkStop, NewError(err.Error(), absPath, source, firstLine.Start)
 					}
+					if err := checkPaths(firstLine.Start, elem.src); err != nil {
+						return ast.WalkStop, err
+					}
+					mdppStack = append(mdppStack, elem)
+				case "mdppif":
+					elem, err := newMdppIfElem(mdppElem, attrs, lookupVariable)
+					if err != nil {
+						return ast.WalkStop, NewError(err.Error(), absPath, source, firstLine.Start)
+					}
+					mdppStack = append(mdppStack, elem)
+					if position, err = writeStrBeforeSegmentsStop(writer, source, position, segments); err != nil {
+						return ast.WalkStop, err
+					}
+					elem.thenStart = writer.Len()
+					if elem.isOff() {
+						skipping = elem
+					}
+				case "mdppelse":
+					var elem *mdppIfElem
+					if len(mdppStack) > 0 {
+						elem, _ = mdppStack[len(mdppStack)-1].(*mdppIfElem)
+					}
+					if elem == nil || elem.Depth() != len(location) || elem.elseStart >= 0 {
+						return ast.WalkStop, NewError("unexpected mdppelse", absPath, source, firstLine.Start)
+					}
+					lineStart := firstLine.Start - len(getIndentBeforeSegment(firstLine, source))
+					if _, err := writer.Write(source[position:lineStart]); err != nil {
+						return ast.WalkStop, err
+					}
+					position = lineStart
+					elem.elseStart = writer.Len()
+					if position, err = writeStrBeforeSegmentsStop(writer, source, position, segments); err != nil {
+						return ast.WalkStop, err
+					}
+					elem.elseEnd = writer.Len()
+					skipping = nil
+					if elem.isOff() {
+						skipping = elem
+					}
+				case "mdpptemplate":
+					elem, err := newMdppTemplateElem(mdppElem, attrs)
+					if err != nil {
+						return ast.WalkStop, NewError(err.Error(), absPath, source, firstLine.Start)
+					}
+					if err := checkPaths(firstLine.Start, elem.template, elem.data); err != nil {
+						return ast.WalkStop, err
+					}
+					mdppStack = append(mdppStack, elem)
 				case "mdppindex":
-					key := match[3]
-					if key == "pattern" {
-						mdppStack = append(mdppStack, &mdppIndexElem{mdppElem, match[4]})
-					} else {
-						return ast.WalkStop, NewError("attribute \"pattern\" required", absPath, source, firstLine.Start)
+					elem, err := newMdppIndexElem(mdppElem, attrs, "tree")
+					if err != nil {
+						return ast.WalkStop, NewError(err.Error(), absPath, source, firstLine.Start)
+					}
+					if options.Config != nil {
+						elem.ignore = options.Config.IsIgnored
+					}
+					elem.sandbox = sb
+					mdppStack = append(mdppStack, elem)
+				case "mdppbacklinks":
+					elem, err := newMdppIndexElem(mdppElem, attrs, "flat")
+					if err != nil {
+						return ast.WalkStop, NewError(err.Error(), absPath, source, firstLine.Start)
+					}
+					if options.Config != nil {
+						elem.ignore = options.Config.IsIgnored
 					}
+					elem.sandbox = sb
+					mdppStack = append(mdppStack, &mdppBacklinksElem{*elem})
 				default:
-					return ast.WalkStop, NewError("unknown MDPP command", absPath, source, firstLine.Start)
+					directive, ok := (*Directive)(nil), false
+					if options.Config != nil {
+						directive, ok = options.Config.Directives[command]
+					}
+					if !ok {
+						return ast.WalkStop, NewError("unknown MDPP command", absPath, source, firstLine.Start)
+					}
+					if directive.Command != nil && !options.AllowExec {
+						return ast.WalkStop, NewError("command execution not allowed: "+command, absPath, source, firstLine.Start)
+					}
+					mdppStack = append(mdppStack, &mdppCustomElem{mdppElem, command, directive, attrs})
 				}
 			} else if strings.HasPrefix(txt, "<!-- /mdpp") {
 				if reEnd == nil {
@@ -272,11 +540,11 @@ func Preprocess(writerOut io.Writer, reader io.Reader,
 				}
 				match := reEnd.FindStringSubmatch(txt)
 				command := match[1]
-				if len(mdppStack) == 0 && command != "mdppcode" {
+				if len(mdppStack) == 0 && command != "mdppcode" && command != "mdpptree" && command != "mdppdiff" {
 					return ast.WalkStop, NewError("unexpected block closing command", absPath, source, firstLine.Start)
 				}
 				switch command {
-				case "mdppcode":
+				case "mdppcode", "mdpptree", "mdppdiff":
 					if len(mdppStack) > 0 && mdppStack[len(mdppStack)-1].Name() == command && mdppStack[len(mdppStack)-1].Depth() == len(location) {
 						mdppStack = mdppStack[:len(mdppStack)-1]
 					}
@@ -289,15 +557,117 @@ func Preprocess(writerOut io.Writer, reader io.Reader,
 
 					}
 					mdppStack = mdppStack[:len(mdppStack)-1]
-					if err := writeIndex(writer, elem.pattern, indent, inPath); err != nil {
+					if err := writeIndex(writer, elem, indent, inPath, options.TitlePolicy); err != nil {
 						return ast.WalkStop, err
 					}
 					if elem.Name() != command || elem.Depth() != len(location) {
 						return ast.WalkStop, NewError("commands do not match", absPath, source, firstLine.Start)
 					}
 					position = firstSegment.Start - len(indent)
+				case "mdppbacklinks":
+					firstSegment := segments.At(0)
+					indent := getIndentBeforeSegment(firstSegment, source)
+					elem, ok := mdppStack[len(mdppStack)-1].(*mdppBacklinksElem)
+					if !ok {
+						return ast.WalkStop, NewError("downcast failed", absPath, source, firstLine.Start)
+					}
+					mdppStack = mdppStack[:len(mdppStack)-1]
+					if elem.Depth() != len(location) {
+						return ast.WalkStop, NewError("commands do not match", absPath, source, firstLine.Start)
+					}
+					if err := writeBacklinks(writer, &elem.mdppIndexElem, indent, inPath, options.TitlePolicy); err != nil {
+						return ast.WalkStop, err
+					}
+					position = firstSegment.Start - len(indent)
+				case "mdppcsv":
+					firstSegment := segments.At(0)
+					indent := getIndentBeforeSegment(firstSegment, source)
+					elem, ok := mdppStack[len(mdppStack)-1].(*mdppCsvElem)
+					if !ok || elem.Depth() != len(location) {
+						return ast.WalkStop, NewError("commands do not match", absPath, source, firstLine.Start)
+					}
+					mdppStack = mdppStack[:len(mdppStack)-1]
+					if err := writeCsvTable(writer, elem.src, &elem.csvOptions, indent); err != nil {
+						return ast.WalkStop, err
+					}
+					position = firstSegment.Start - len(indent)
+				case "mdppif":
+					firstSegment := segments.At(0)
+					indent := getIndentBeforeSegment(firstSegment, source)
+					elem, ok := mdppStack[len(mdppStack)-1].(*mdppIfElem)
+					if !ok || elem.Depth() != len(location) {
+						return ast.WalkStop, NewError("commands do not match", absPath, source, firstLine.Start)
+					}
+					mdppStack = mdppStack[:len(mdppStack)-1]
+					skipping = nil
+					lineStart := firstSegment.Start - len(indent)
+					if _, err := writer.Write(source[position:lineStart]); err != nil {
+						return ast.WalkStop, err
+					}
+					position = lineStart
+					metadata, err := getDocumentMetadata()
+					if err != nil {
+						return ast.WalkStop, err
+					}
+					rewriteBranch := func(content []byte, enabled bool) ([]byte, error) {
+						content, wasDisabled := enableBranch(content)
+						if !enabled {
+							if elem.remove {
+								return nil, nil
+							}
+							return disableBranch(content, indent), nil
+						}
+						if !wasDisabled {
+							return content, nil
+						}
+						// The restored branch has not been preprocessed yet
+						output := bytes.NewBuffer(nil)
+						if _, _, err := preprocess(output, bytes.NewReader(dedentLines(content, indent)), "", inPath, options, metadata); err != nil {
+							return nil, err
+						}
+						return indentLines(output.Bytes(), indent), nil
+					}
+					output := append([]byte(nil), writer.Bytes()[elem.thenStart:]...)
+					thenBranch, elseLine, elseBranch := output, []byte(nil), []byte(nil)
+					if elem.elseStart >= 0 {
+						thenBranch = output[:elem.elseStart-elem.thenStart]
+						elseLine = output[elem.elseStart-elem.thenStart : elem.elseEnd-elem.thenStart]
+						elseBranch = output[elem.elseEnd-elem.thenStart:]
+					}
+					if thenBranch, err = rewriteBranch(thenBranch, elem.condition); err != nil {
+						return ast.WalkStop, err
+					}
+					if elseBranch, err = rewriteBranch(elseBranch, !elem.condition); err != nil {
+						return ast.WalkStop, err
+					}
+					writer.Truncate(elem.thenStart)
+					if _, err := writer.Write(concatBytes(thenBranch, elseLine, elseBranch)); err != nil {
+						return ast.WalkStop, err
+					}
+				case "mdpptemplate":
+					firstSegment := segments.At(0)
+					indent := getIndentBeforeSegment(firstSegment, source)
+					elem, ok := mdppStack[len(mdppStack)-1].(*mdppTemplateElem)
+					if !ok || elem.Depth() != len(location) {
+						return ast.WalkStop, NewError("commands do not match", absPath, source, firstLine.Start)
+					}
+					mdppStack = mdppStack[:len(mdppStack)-1]
+					if err := writeTemplate(writer, elem.template, elem.data, indent, options.TitlePolicy, sb); err != nil {
+						return ast.WalkStop, err
+					}
+					position = firstSegment.Start - len(indent)
 				default:
-					return ast.WalkStop, NewError("unknown closing command", absPath, source, firstLine.Start)
+					elem, ok := mdppStack[len(mdppStack)-1].(*mdppCustomElem)
+					if !ok || elem.Name() != command || elem.Depth() != len(location) {
+						return ast.WalkStop, NewError("unknown closing command", absPath, source, firstLine.Start)
+					}
+					firstSegment := segments.At(0)
+					indent := getIndentBeforeSegment(firstSegment, source)
+					mdppStack = mdppStack[:len(mdppStack)-1]
+					if err := elem.directive.write(writer, elem.attrs, lookupVariable, indent, options.TitlePolicy, sb); err != nil {
+						return ast.WalkStop, NewError(err.Error(), absPath, source, firstLine.Start)
+					}
+					position = firstSegment.Start - len(indent)
 				}
 			}
 			position, err = writeStrBeforeSegmentsStop(writer, source, position, segments)
@@ -307,26 +677,71 @@ func Preprocess(writerOut io.Writer, reader io.Reader,
 		case ast.KindCodeBlock:
 			fallthrough
 		case ast.KindFencedCodeBlock:
-			if len(mdppStack) == 0 || mdppStack[len(mdppStack)-1].Name() != "mdppcode" {
+			if len(mdppStack) == 0 {
 				break
 			}
-			segments := node.Lines()
-			if segments.Len() == 0 {
-				return ast.WalkStop, NewError("empty fenced code block", absPath, source, position)
+			filler, ok := mdppStack[len(mdppStack)-1].(mdppCodeFiller)
+			if !ok {
+				break
+			}
+			mdppStack = mdppStack[:len(mdppStack)-1]
+			fence := filler.getCodeFence()
+			info, setsInfo := fence.info()
+			content := bytes.NewBuffer(nil)
+			if node.Kind() == ast.KindFencedCodeBlock {
+				// The fence lines are rewritten as well
+				block, ok := getFencedBlock(source, node.(*ast.FencedCodeBlock))
+				if !ok {
+					return ast.WalkStop, NewError("fence of the code block not found", absPath, source, position)
+				}
+				if err := filler.writeCode(content, block.indent); err != nil {
+					return ast.WalkStop, err
+				}
+				newFence := getFence(content.Bytes(), block.fence)
+				opening, closing := block.opening, block.closing
+				if setsInfo || newFence != block.fence {
+					if !setsInfo {
+						info = strings.TrimSpace(opening[len(block.prefix)+len(block.fence):])
+					}
+					opening = block.prefix + newFence + info
+				}
+				if closing == "" || newFence != block.fence {
+					closing = block.indent + newFence
+				}
+				if _, err := writer.Write(source[position:block.start]); err != nil {
+					return ast.WalkStop, err
+				}
+				if _, err := fmt.Fprintf(writer, "%s\n%s%s\n", opening, content.Bytes(), closing); err != nil {
+					return ast.WalkStop, err
+				}
+				position = block.end
+				break
 			}
+			segments := node.Lines()
 			firstSegment := segments.At(0)
 			indent := getIndentBeforeSegment(firstSegment, source)
+			if fence.fenced || setsInfo {
+				// Converts the indented code block into a fenced one
+				lineStart := firstSegment.Start - len(indent)
+				indent = getContainerIndent(indent)
+				if err := filler.writeCode(content, indent); err != nil {
+					return ast.WalkStop, err
+				}
+				newFence := getFence(content.Bytes(), "```")
+				if _, err := writer.Write(source[position:lineStart]); err != nil {
+					return ast.WalkStop, err
+				}
+				if _, err := fmt.Fprintf(writer, "%s%s%s\n%s%s%s\n", indent, newFence, info, content.Bytes(), indent, newFence); err != nil {
+					return ast.WalkStop, err
+				}
+				position = segments.At(segments.Len() - 1).Stop
+				break
+			}
 			position, err = writeStrBeforeSegmentsStart(writer, source, position, segments, -len(indent))
 			if err != nil {
 				return ast.WalkStop, err
 			}
-			mdppCodeElem1, ok := mdppStack[len(mdppStack)-1].(*mdppCodeElem)
-			if !ok {
-				return ast.WalkStop, NewError("downcast failed", absPath, source, firstSegment.Start)
-			}
-			mdppStack = mdppStack[:len(mdppStack)-1]
-			err := writeFileWithIndent(writer, mdppCodeElem1.filepath, indent)
-			if err != nil {
+			if err := filler.writeCode(writer, indent); err != nil {
 				return ast.WalkStop, err
 			}
 		}
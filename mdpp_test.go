@@ -2,8 +2,15 @@ package mdpp
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/andreyvit/diff"
 )
@@ -300,6 +307,247 @@ Main document.
 	}
 }
 
+func TestTitleQuotedColon(t *testing.T) {
+	input1 := bytes.NewBufferString(`---
+title: "Part 1: Introduction"
+---
+`)
+	title := GetMarkdownTitleSub(input1, "default")
+	if title != "Part 1: Introduction" {
+		t.Fatal("Could not get title", title)
+	}
+}
+
+func TestMetadataYaml(t *testing.T) {
+	input1 := bytes.NewBufferString(`---
+Title: >-
+  A long
+  title
+tags: [foo, bar]
+weight: 10
+draft: false
+---
+Document.
+`)
+	metadata, style, err := GetMarkdownMetadataSub(input1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if style != YamlMetadataBlockStyle {
+		t.Fatal("Unexpected style", style)
+	}
+	if title, _ := metadata.GetString("title"); title != "A long title" {
+		t.Fatal("Could not get title", title)
+	}
+	if tags, _ := metadata.GetString("tags"); tags != "foo, bar" {
+		t.Fatal("Could not get tags", tags)
+	}
+	if metadata["weight"] != 10 || metadata["draft"] != false {
+		t.Fatal("Unexpected values", metadata)
+	}
+}
+
+func TestMetadataPandoc(t *testing.T) {
+	input1 := bytes.NewBufferString(`% My Document
+% Foo Bar; Baz Qux
+  Quux Corge
+% 2022-01-02
+
+Document.
+`)
+	metadata, style, err := GetMarkdownMetadataSub(input1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if style != PandocTitleBlockStyle {
+		t.Fatal("Unexpected style", style)
+	}
+	if author, _ := metadata.GetString("author"); author != "Foo Bar, Baz Qux, Quux Corge" {
+		t.Fatal("Could not get authors", author)
+	}
+	if date, _ := metadata.GetString("date"); date != "2022-01-02" {
+		t.Fatal("Could not get date", date)
+	}
+}
+
+func TestMetadataMultiMarkdown(t *testing.T) {
+	input1 := bytes.NewBufferString(`Title:   My title
+Author:  Foo Bar
+Base Header Level: 2
+Abstract: This is
+    continued.
+
+Main document.
+`)
+	metadata, style, err := GetMarkdownMetadataSub(input1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if style != MultiMarkdownStyle {
+		t.Fatal("Unexpected style", style)
+	}
+	if metadata["baseheaderlevel"] != "2" || metadata["abstract"] != "This is continued." {
+		t.Fatal("Unexpected values", metadata)
+	}
+}
+
+func TestMetadataToml(t *testing.T) {
+	input1 := bytes.NewBufferString(`+++
+title = "My TOML: Document"
+tags = ["foo", "bar"]
+date = 2022-01-02
+
+[params]
+weight = 3
++++
+Document.
+`)
+	metadata, style, err := GetMarkdownMetadataSub(input1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if style != TomlFrontMatterStyle {
+		t.Fatal("Unexpected style", style)
+	}
+	if title, _ := metadata.GetString("title"); title != "My TOML: Document" {
+		t.Fatal("Could not get title", title)
+	}
+	if tags, _ := metadata.GetString("tags"); tags != "foo, bar" {
+		t.Fatal("Could not get tags", tags)
+	}
+	if weight, _ := metadata.GetString("params.weight"); weight != "3" {
+		t.Fatal("Could not get nested field", weight)
+	}
+	if style.String() != "toml" {
+		t.Fatal("Unexpected style name", style.String())
+	}
+}
+
+func TestMetadataJson(t *testing.T) {
+	input1 := bytes.NewBufferString(`{
+  "title": "My JSON Document",
+  "draft": true
+}
+
+Document.
+`)
+	metadata, style, err := GetMarkdownMetadataSub(input1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if style != JsonFrontMatterStyle {
+		t.Fatal("Unexpected style", style)
+	}
+	if title, _ := metadata.GetString("title"); title != "My JSON Document" || metadata["draft"] != true {
+		t.Fatal("Unexpected values", metadata)
+	}
+}
+
+func TestMetadataNotJson(t *testing.T) {
+	for _, input := range []string{
+		"{{ partial \"header.html\" . }}\n\n# Title\n",
+		"{% include header.html %}\n\n# Title\n",
+	} {
+		metadata, style, err := GetMarkdownMetadataSub(bytes.NewBufferString(input))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if style != UnknownStyle || len(metadata) != 0 {
+			t.Fatal("Unexpected metadata", style, metadata)
+		}
+		if title := GetMarkdownTitleSub(bytes.NewBufferString(input), "default"); title != "Title" {
+			t.Fatal("Could not get title", title)
+		}
+	}
+}
+
+func TestTitleHeading(t *testing.T) {
+	input := `Preface
+
+My *Setext* Title
+=================
+
+# ATX Title
+`
+	if title := GetMarkdownTitleSub(bytes.NewBufferString(input), "default"); title != "My Setext Title" {
+		t.Fatal("Could not get title", title)
+	}
+	if title := GetMarkdownTitleSubWithPolicy(bytes.NewBufferString(input), "default", FrontMatterOnlyPolicy); title != "default" {
+		t.Fatal("How did you get it?", title)
+	}
+	input = `---
+title: Front Matter Title
+---
+
+# ATX Title
+`
+	if title := GetMarkdownTitleSubWithPolicy(bytes.NewBufferString(input), "default", HeadingOnlyPolicy); title != "ATX Title" {
+		t.Fatal("Could not get title", title)
+	}
+}
+
+// Comments in the metadata blocks are not headings
+func TestTitleCommentInMetadata(t *testing.T) {
+	for _, input := range []string{
+		"---\n# comment\ndraft: true\n---\n\nBody\n",
+		"+++\n# comment\ndraft = true\n+++\n\nBody\n",
+		"---\n# comment\ndraft: [\n---\n\nBody\n",
+	} {
+		if title := GetMarkdownTitleSub(bytes.NewBufferString(input), "default"); title != "default" {
+			t.Fatal("Comment taken as title", title)
+		}
+		input += "\n# Heading\n"
+		if title := GetMarkdownTitleSub(bytes.NewBufferString(input), "default"); title != "Heading" {
+			t.Fatal("Could not get title", title)
+		}
+	}
+}
+
+func TestSetTitle(t *testing.T) {
+	for _, c := range []struct {
+		input    string
+		expected string
+	}{
+		{"---\nauthor: foo\nTitle: >-\n  Old\n  title\ndate: 2022-01-02\n---\nbody\n",
+			"---\nauthor: foo\nTitle: 'New: タイトル'\ndate: 2022-01-02\n---\nbody\n"},
+		{"---\nauthor: foo\n---\nbody\n",
+			"---\ntitle: 'New: タイトル'\nauthor: foo\n---\nbody\n"},
+		{"---\ntitle: |\n  line one\n\n  line two\n\nauthor: x\n---\nbody\n",
+			"---\ntitle: 'New: タイトル'\n\nauthor: x\n---\nbody\n"},
+		{"+++\ntitle = \"Old\" # comment\n+++\nbody\n",
+			"+++\ntitle = \"New: タイトル\"\n+++\nbody\n"},
+		{"+++\n[params]\ntitle = 1\n+++\n",
+			"+++\ntitle = \"New: タイトル\"\n[params]\ntitle = 1\n+++\n"},
+		{"+++\ntitle = \"\"\"\nOld\ntitle\"\"\"\ndraft = true\n+++\n",
+			"+++\ntitle = \"New: タイトル\"\ndraft = true\n+++\n"},
+		{"+++\n\"Title\" = 'Old'\n+++\n",
+			"+++\n\"Title\" = \"New: タイトル\"\n+++\n"},
+		{"+++\nsummary = '''\ntitle = 1\n'''\n+++\n",
+			"+++\ntitle = \"New: タイトル\"\nsummary = '''\ntitle = 1\n'''\n+++\n"},
+		{"% Old\n  title\n% Author\n\nbody\n",
+			"% New: タイトル\n% Author\n\nbody\n"},
+		{"Author: foo\r\nTitle: Old\r\n  title\r\n\r\nbody\r\n",
+			"Author: foo\r\nTitle: New: タイトル\r\n\r\nbody\r\n"},
+		{"Author: foo\n\nbody\n",
+			"Title: New: タイトル\nAuthor: foo\n\nbody\n"},
+		{"# Heading\n",
+			"---\ntitle: 'New: タイトル'\n---\n# Heading\n"},
+	} {
+		output, err := SetMarkdownTitle([]byte(c.input), "New: タイトル")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(output) != c.expected {
+			t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(c.expected, string(output)))
+		}
+		if title := GetMarkdownTitleSubWithPolicy(bytes.NewReader(output), "default", FrontMatterOnlyPolicy); title != "New: タイトル" {
+			t.Fatal("Could not get the new title", title)
+		}
+	}
+}
+
 // Unknown commands are ignored
 func TestUnknown(t *testing.T) {
 	input := bytes.NewBufferString(`Includes:
@@ -384,10 +632,279 @@ func TestIndexRec(t *testing.T) {
 <!-- /mdppindex -->
 `)
 	expected := []byte(`<!-- mdppindex pattern=misc/**/*.txt -->
-* misc/dir1/dir1-1
-  * [foo.txt](misc/dir1/dir1-1/foo.txt)
-* misc/dir2
-  * [bar.txt](misc/dir2/bar.txt)
+* misc
+  * dir1
+    * dir1-1
+      * [foo.txt](misc/dir1/dir1-1/foo.txt)
+  * dir2
+    * [bar.txt](misc/dir2/bar.txt)
+<!-- /mdppindex -->
+`)
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, input); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+}
+
+func TestIndexExclude(t *testing.T) {
+	input := bytes.NewBufferString(`<!-- mdppindex pattern=misc/**/*.md exclude="**/drafts misc/*.md misc/docs/*.md" skip-hidden=true -->
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/**/.hidden.md -->
+<!-- /mdppindex -->
+`)
+	expected := []byte(`<!-- mdppindex pattern=misc/**/*.md exclude="**/drafts misc/*.md misc/docs/*.md" skip-hidden=true -->
+* misc
+  * docs
+    * api
+      * [API Reference](misc/docs/api/index.md)
+      * v1
+        * [Endpoints](misc/docs/api/v1/endpoints.md)
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/**/.hidden.md -->
+* misc
+  * docs
+    * [Hidden](misc/docs/.hidden.md)
+<!-- /mdppindex -->
+`)
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, input); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+}
+
+func TestIndexDirTitle(t *testing.T) {
+	input := bytes.NewBufferString(`<!-- mdppindex pattern=misc/docs/**/*.md exclude=misc/docs/drafts skip-hidden=true dir-title=true -->
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/**/*.md exclude=misc/docs/drafts skip-hidden=true dir-title=true depth=3 -->
+<!-- /mdppindex -->
+`)
+	expected := []byte(`<!-- mdppindex pattern=misc/docs/**/*.md exclude=misc/docs/drafts skip-hidden=true dir-title=true -->
+* misc
+  * [Documents](misc/docs/README.md)
+    * [Advanced Topics](misc/docs/10-advanced.md)
+    * [Usage](misc/docs/2-usage.md)
+    * [API Reference](misc/docs/api/index.md)
+      * v1
+        * [Endpoints](misc/docs/api/v1/endpoints.md)
+    * [Introduction](misc/docs/intro.md)
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/**/*.md exclude=misc/docs/drafts skip-hidden=true dir-title=true depth=3 -->
+* misc
+  * [Documents](misc/docs/README.md)
+    * [Advanced Topics](misc/docs/10-advanced.md)
+    * [Usage](misc/docs/2-usage.md)
+    * [API Reference](misc/docs/api/index.md)
+    * [Introduction](misc/docs/intro.md)
+<!-- /mdppindex -->
+`)
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, input); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+}
+
+func TestIndexSort(t *testing.T) {
+	input := bytes.NewBufferString(`<!-- mdppindex pattern=misc/docs/*.md skip-hidden=true sort=weight -->
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/*.md skip-hidden=true sort=weight reverse=true -->
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/*.md skip-hidden=true sort=natural -->
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/*.md skip-hidden=true sort=date -->
+<!-- /mdppindex -->
+`)
+	expected := []byte(`<!-- mdppindex pattern=misc/docs/*.md skip-hidden=true sort=weight -->
+* misc
+  * docs
+    * [Introduction](misc/docs/intro.md)
+    * [Usage](misc/docs/2-usage.md)
+    * [Advanced Topics](misc/docs/10-advanced.md)
+    * [Documents](misc/docs/README.md)
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/*.md skip-hidden=true sort=weight reverse=true -->
+* misc
+  * docs
+    * [Advanced Topics](misc/docs/10-advanced.md)
+    * [Usage](misc/docs/2-usage.md)
+    * [Introduction](misc/docs/intro.md)
+    * [Documents](misc/docs/README.md)
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/*.md skip-hidden=true sort=natural -->
+* misc
+  * docs
+    * [Usage](misc/docs/2-usage.md)
+    * [Advanced Topics](misc/docs/10-advanced.md)
+    * [Documents](misc/docs/README.md)
+    * [Introduction](misc/docs/intro.md)
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/*.md skip-hidden=true sort=date -->
+* misc
+  * docs
+    * [Usage](misc/docs/2-usage.md)
+    * [Introduction](misc/docs/intro.md)
+    * [Advanced Topics](misc/docs/10-advanced.md)
+    * [Documents](misc/docs/README.md)
+<!-- /mdppindex -->
+`)
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, input); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+}
+
+func TestIndexSortModTime(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for i, name := range []string{"b.md", "c.md", "a.md"} {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte("# "+name+"\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		modTime := now.Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(p, modTime, modTime); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	input := bytes.NewBufferString(`<!-- mdppindex pattern=*.md sort=mtime reverse=true -->
+<!-- /mdppindex -->
+`)
+	expected := []byte(`<!-- mdppindex pattern=*.md sort=mtime reverse=true -->
+* [a.md](./a.md)
+* [c.md](./c.md)
+* [b.md](./b.md)
+<!-- /mdppindex -->
+`)
+	output := bytes.NewBuffer(nil)
+	if _, _, err := Preprocess(output, input, dir, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+}
+
+func TestIndexWhere(t *testing.T) {
+	input := bytes.NewBufferString(`<!-- mdppindex pattern=misc/docs/**/*.md where="draft!=true && category == guide" -->
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/**/*.md where='tags contains api and not (date < 2022-01-01)' -->
+<!-- /mdppindex -->
+`)
+	expected := []byte(`<!-- mdppindex pattern=misc/docs/**/*.md where="draft!=true && category == guide" -->
+* misc
+  * docs
+    * [Advanced Topics](misc/docs/10-advanced.md)
+    * [Introduction](misc/docs/intro.md)
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/**/*.md where='tags contains api and not (date < 2022-01-01)' -->
+* misc
+  * docs
+    * [Advanced Topics](misc/docs/10-advanced.md)
+    * api
+      * [API Reference](misc/docs/api/index.md)
+<!-- /mdppindex -->
+`)
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, input); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+}
+
+func TestIndexWhereError(t *testing.T) {
+	input := bytes.NewBufferString(`<!-- mdppindex pattern=misc/docs/**/*.md where="draft ==" -->
+<!-- /mdppindex -->
+`)
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, input); err == nil || !strings.HasPrefix(err.Error(), "unexpected end in expression") {
+		t.Fatal("not expected error", err)
+	}
+}
+
+func TestIndexLayout(t *testing.T) {
+	input := bytes.NewBufferString(`* flat
+
+  <!-- mdppindex pattern=misc/docs/*.md skip-hidden=true sort=weight layout=flat -->
+  <!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/*.md skip-hidden=true where=weight sort=weight layout=numbered -->
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/*.md skip-hidden=true where=weight sort=weight layout=table columns="title,date:Published,tags" -->
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/*.md skip-hidden=true where=weight sort=weight layout=definition -->
+<!-- /mdppindex -->
+`)
+	expected := []byte(`* flat
+
+  <!-- mdppindex pattern=misc/docs/*.md skip-hidden=true sort=weight layout=flat -->
+  * [Introduction](misc/docs/intro.md)
+  * [Usage](misc/docs/2-usage.md)
+  * [Advanced Topics](misc/docs/10-advanced.md)
+  * [Documents](misc/docs/README.md)
+  <!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/*.md skip-hidden=true where=weight sort=weight layout=numbered -->
+1. [Introduction](misc/docs/intro.md)
+2. [Usage](misc/docs/2-usage.md)
+3. [Advanced Topics](misc/docs/10-advanced.md)
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/*.md skip-hidden=true where=weight sort=weight layout=table columns="title,date:Published,tags" -->
+| Title | Published | Tags |
+| --- | --- | --- |
+| [Introduction](misc/docs/intro.md) | 2022-01-10 | guide |
+| [Usage](misc/docs/2-usage.md) | 2021-12-24 | api, guide |
+| [Advanced Topics](misc/docs/10-advanced.md) | 2022-03-01 | api |
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/*.md skip-hidden=true where=weight sort=weight layout=definition -->
+[Introduction](misc/docs/intro.md)
+:   How to get started.
+
+[Usage](misc/docs/2-usage.md)
+:   How to use the commands.
+
+[Advanced Topics](misc/docs/10-advanced.md)
+:   Tips | tricks.
 <!-- /mdppindex -->
 `)
 	output := bytes.NewBuffer(nil)
@@ -400,3 +917,992 @@ func TestIndexRec(t *testing.T) {
 %s`, diff.LineDiff(string(expected), output.String()))
 	}
 }
+
+func TestIndexColumns(t *testing.T) {
+	columns, err := parseIndexColumns("title,échéance, date:Published")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(columns) != 3 || columns[1].label != "Échéance" || columns[2].label != "Published" {
+		t.Fatal("Unexpected columns", columns)
+	}
+	input := bytes.NewBufferString(`<!-- mdppindex pattern=misc/docs/*.md layout=table columns="" -->
+<!-- /mdppindex -->
+`)
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, input); err == nil || !strings.HasPrefix(err.Error(), "no columns") {
+		t.Fatal("not expected error", err)
+	}
+}
+
+func TestIndexGroup(t *testing.T) {
+	input := bytes.NewBufferString(`<!-- mdppindex pattern=misc/docs/*.md skip-hidden=true layout=flat sort=weight group=category -->
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/**/*.md skip-hidden=true layout=flat group=tags group-heading=3 group-order=desc -->
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/**/*.md where="date" layout=flat sort=date group=date:year group-order=first -->
+<!-- /mdppindex -->
+`)
+	expected := []byte(`<!-- mdppindex pattern=misc/docs/*.md skip-hidden=true layout=flat sort=weight group=category -->
+* guide
+  * [Introduction](misc/docs/intro.md)
+  * [Advanced Topics](misc/docs/10-advanced.md)
+* reference
+  * [Usage](misc/docs/2-usage.md)
+* Others
+  * [Documents](misc/docs/README.md)
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/**/*.md skip-hidden=true layout=flat group=tags group-heading=3 group-order=desc -->
+### guide
+
+* [Usage](misc/docs/2-usage.md)
+* [Introduction](misc/docs/intro.md)
+
+### api
+
+* [Advanced Topics](misc/docs/10-advanced.md)
+* [Usage](misc/docs/2-usage.md)
+* [API Reference](misc/docs/api/index.md)
+
+### Others
+
+* [Documents](misc/docs/README.md)
+* [Endpoints](misc/docs/api/v1/endpoints.md)
+* [Work in Progress](misc/docs/drafts/wip.md)
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/**/*.md where="date" layout=flat sort=date group=date:year group-order=first -->
+* 2021
+  * [Usage](misc/docs/2-usage.md)
+* 2022
+  * [Introduction](misc/docs/intro.md)
+  * [API Reference](misc/docs/api/index.md)
+  * [Advanced Topics](misc/docs/10-advanced.md)
+  * [Work in Progress](misc/docs/drafts/wip.md)
+<!-- /mdppindex -->
+`)
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, input); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+}
+
+func TestIndexLimit(t *testing.T) {
+	input := bytes.NewBufferString(`<!-- mdppindex pattern=misc/docs/**/*.md where=date sort=date reverse=true limit=2 layout=flat more=misc/docs/README.md -->
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/**/*.md where=date sort=date offset=1 limit=2 layout=numbered more=misc/docs/README.md more-label=All -->
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/**/*.md where=date sort=date offset=3 layout=flat more=misc/docs/README.md -->
+<!-- /mdppindex -->
+`)
+	expected := []byte(`<!-- mdppindex pattern=misc/docs/**/*.md where=date sort=date reverse=true limit=2 layout=flat more=misc/docs/README.md -->
+* [Work in Progress](misc/docs/drafts/wip.md)
+* [Advanced Topics](misc/docs/10-advanced.md)
+* [More…](misc/docs/README.md)
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/**/*.md where=date sort=date offset=1 limit=2 layout=numbered more=misc/docs/README.md more-label=All -->
+1. [Introduction](misc/docs/intro.md)
+2. [API Reference](misc/docs/api/index.md)
+3. [All](misc/docs/README.md)
+<!-- /mdppindex -->
+
+<!-- mdppindex pattern=misc/docs/**/*.md where=date sort=date offset=3 layout=flat more=misc/docs/README.md -->
+* [Advanced Topics](misc/docs/10-advanced.md)
+* [Work in Progress](misc/docs/drafts/wip.md)
+<!-- /mdppindex -->
+`)
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, input); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+}
+
+func TestIndexNonMarkdown(t *testing.T) {
+	input := bytes.NewBufferString(`<!-- mdppindex pattern=misc/src/* layout=flat -->
+<!-- /mdppindex -->
+`)
+	expected := []byte(`<!-- mdppindex pattern=misc/src/* layout=flat -->
+* [Greeting script](misc/src/greet.py)
+* [map.js](misc/src/map.js)
+* [Notes on C](misc/src/notes.c)
+* [Page & Title](misc/src/page.html)
+* [settings.cfg](misc/src/settings.cfg)
+<!-- /mdppindex -->
+`)
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, input); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+}
+
+func TestBacklinks(t *testing.T) {
+	input := bytes.NewBufferString(`Backlinks:
+
+<!-- mdppbacklinks pattern=**/*.md -->
+* [Deleted](deleted.md)
+<!-- /mdppbacklinks -->
+`)
+	expected := []byte(`Backlinks:
+
+<!-- mdppbacklinks pattern=**/*.md -->
+* [Documents](./README.md)
+* [Endpoints](api/v1/endpoints.md)
+<!-- /mdppbacklinks -->
+`)
+	output := bytes.NewBuffer(nil)
+	if _, _, err := Preprocess(output, input, "misc/docs", "intro.md"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+}
+
+func TestTree(t *testing.T) {
+	// The directories are made here so that the fixtures added under misc do
+	// not change the output
+	dir := t.TempDir()
+	for _, path := range []string{"project/src/main.c", "project/docs/api/index.md", "project/lib/sub/util.c", "project/README.md", "project/tests/.keep"} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	input := bytes.NewBufferString(`Layout:
+
+<!-- mdpptree dir=misc/docs depth=2 exclude=drafts comments=misc/tree-comments -->
+
+` + "```" + `
+outdated
+` + "```" + `
+`)
+	expected := []byte(`Layout:
+
+<!-- mdpptree dir=misc/docs depth=2 exclude=drafts comments=misc/tree-comments -->
+
+` + "```" + `
+misc/docs
+├── 10-advanced.md
+├── 2-usage.md
+├── README.md       # The top page
+├── api             # API documents
+│   ├── index.md
+│   └── v1          # Version 1
+└── intro.md
+` + "```" + `
+`)
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, input); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+	input = bytes.NewBufferString(`<!-- mdpptree dir=project dirs-only=true exclude="docs/*" -->
+
+    outdated
+`)
+	expected = []byte(`<!-- mdpptree dir=project dirs-only=true exclude="docs/*" -->
+
+    project
+    ├── docs
+    ├── lib
+    │   └── sub
+    ├── src
+    └── tests
+`)
+	output = bytes.NewBuffer(nil)
+	if _, _, err := Preprocess(output, input, dir, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+}
+
+func TestCsv(t *testing.T) {
+	input := bytes.NewBufferString(`Matrix:
+
+<!-- mdppcsv src=misc/data/matrix.csv columns="name:Name,version:Version,note" align=left,right -->
+| Outdated |
+<!-- /mdppcsv -->
+
+Settings:
+
+<!-- mdppcsv src=misc/data/settings.tsv header=false -->
+<!-- /mdppcsv -->
+`)
+	expected := []byte(`Matrix:
+
+<!-- mdppcsv src=misc/data/matrix.csv columns="name:Name,version:Version,note" align=left,right -->
+| Name | Version | note |
+| :--- | ---: | ---: |
+| alpha | 1.2 | stable, tested |
+| beta | 0.9 | uses a \| pipe |
+| gamma | 10 |  |
+<!-- /mdppcsv -->
+
+Settings:
+
+<!-- mdppcsv src=misc/data/settings.tsv header=false -->
+|  |  |
+| --- | --- |
+| key | value |
+| foo | 1 |
+| bar | 2 |
+<!-- /mdppcsv -->
+`)
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, input); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	input := bytes.NewBufferString(`* Matrix
+
+  <!-- mdpptemplate data=misc/data/versions.yaml template=misc/data/matrix.md.tmpl -->
+  Outdated
+  <!-- /mdpptemplate -->
+`)
+	expected := []byte(`* Matrix
+
+  <!-- mdpptemplate data=misc/data/versions.yaml template=misc/data/matrix.md.tmpl -->
+  Releases of mdpp:
+
+  | Version | Date | Platforms | Notes |
+  | --- | --- | --- | --- |
+  | [1.1](releases/1.1.md) | 2022-05-01 | linux, darwin | Adds \*templates\* |
+  | [1.0](releases/1.0.md) | 2022-01-15 | linux | First release |
+  <!-- /mdpptemplate -->
+`)
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, input); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+}
+
+func TestVariables(t *testing.T) {
+	input := bytes.NewBufferString(`---
+title: Release notes
+version: 1.1.0
+---
+
+The <!-- mdppvar name=title --><!-- /mdppvar --> of <!-- mdppvar name=product -->x<!-- /mdppvar -->
+Version <!-- mdppvar name=version -->x<!-- /mdppvar --> (<!-- mdppvar name=release.date -->x<!-- /mdppvar -->)
+by <!-- mdppvar name=author -->x<!-- /mdppvar -->
+`)
+	expected := []byte(`---
+title: Release notes
+version: 1.1.0
+---
+
+The <!-- mdppvar name=title -->Release notes<!-- /mdppvar --> of <!-- mdppvar name=product -->mdpp<!-- /mdppvar -->
+Version <!-- mdppvar name=version -->1.1.0<!-- /mdppvar --> (<!-- mdppvar name=release.date -->2022-05-01<!-- /mdppvar -->)
+by <!-- mdppvar name=author -->Alice<!-- /mdppvar -->
+`)
+	configPath, err := FindConfigFile("misc/config")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	options := &Options{Variables: map[string]string{"author": "Alice"}, Config: config}
+	output := bytes.NewBuffer(nil)
+	if _, _, err := PreprocessWithOptions(output, input, "", "", options); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+	input = bytes.NewBufferString("Version <!-- mdppvar name=version -->x<!-- /mdppvar -->\n")
+	if err := PreprocessWithoutDir(bytes.NewBuffer(nil), input); err == nil || !strings.Contains(err.Error(), "undefined variable") {
+		t.Fatal("undefined variable should be an error")
+	}
+}
+
+func TestIf(t *testing.T) {
+	source := `---
+edition: internal
+---
+
+<!-- mdppif expr="edition == 'internal'" -->
+
+Internal: <!-- mdpplink href=misc/docs/intro.md --><!-- /mdpplink -->
+
+<!-- mdppelse -->
+
+External only.
+
+<!-- /mdppif -->
+
+* Item
+
+  <!-- mdppif expr="not (edition == internal)" mode=remove -->
+  Removed
+  <!-- /mdppif -->
+`
+	expected := `---
+edition: internal
+---
+
+<!-- mdppif expr="edition == 'internal'" -->
+
+Internal: <!-- mdpplink href=misc/docs/intro.md -->[Introduction](misc/docs/intro.md)<!-- /mdpplink -->
+
+<!-- mdppelse -->
+<!-- mdppoff
+
+External only.
+
+-->
+<!-- /mdppif -->
+
+* Item
+
+  <!-- mdppif expr="not (edition == internal)" mode=remove -->
+  <!-- /mdppif -->
+`
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, bytes.NewBufferString(source)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if expected != output.String() {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(expected, output.String()))
+	}
+	// Switching the edition restores the disabled branch and disables the other
+	options := &Options{Variables: map[string]string{"edition": "external"}}
+	input := bytes.NewBufferString(expected)
+	output = bytes.NewBuffer(nil)
+	if _, _, err := PreprocessWithOptions(output, input, "", "", options); err != nil {
+		t.Fatal(err.Error())
+	}
+	expected = `---
+edition: internal
+---
+
+<!-- mdppif expr="edition == 'internal'" -->
+<!-- mdppoff
+
+Internal: <!-- mdpplink href=misc/docs/intro.md --\>[Introduction](misc/docs/intro.md)<!-- /mdpplink --\>
+
+-->
+<!-- mdppelse -->
+
+External only.
+
+<!-- /mdppif -->
+
+* Item
+
+  <!-- mdppif expr="not (edition == internal)" mode=remove -->
+  <!-- /mdppif -->
+`
+	if expected != output.String() {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(expected, output.String()))
+	}
+	input = bytes.NewBufferString(expected)
+	output = bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, input); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(output.String(), "\nInternal: <!-- mdpplink href=misc/docs/intro.md -->[Introduction](misc/docs/intro.md)<!-- /mdpplink -->\n") {
+		t.Fatalf("Not restored:\n\n%s", output.String())
+	}
+}
+
+func TestIfIndented(t *testing.T) {
+	source := `* item
+
+  <!-- mdppif expr="x == 1" -->
+  one
+  <!-- /mdppif -->
+`
+	disabled := `* item
+
+  <!-- mdppif expr="x == 1" -->
+  <!-- mdppoff
+  one
+  -->
+  <!-- /mdppif -->
+`
+	run := func(input string, x string) (string, bool) {
+		output := bytes.NewBuffer(nil)
+		options := &Options{Variables: map[string]string{"x": x}}
+		_, changed, err := PreprocessWithOptions(output, bytes.NewBufferString(input), "", "", options)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return output.String(), changed
+	}
+	output, _ := run(source, "2")
+	if output != disabled {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(disabled, output))
+	}
+	// Disabling again changes nothing
+	output, changed := run(output, "2")
+	if changed || output != disabled {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(disabled, output))
+	}
+	if output, _ = run(output, "1"); output != source {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(source, output))
+	}
+}
+
+func TestIfSkipsDisabledBranch(t *testing.T) {
+	source := `<!-- mdppif expr="version" -->
+Version <!-- mdppvar name=version --><!-- /mdppvar -->
+
+<!-- mdppcode src=internal/secret.c -->
+
+    secret
+
+<!-- mdppif expr="true" -->
+<!-- mdppelse -->
+<!-- /mdppif -->
+<!-- mdppelse -->
+No version.
+<!-- /mdppif -->
+`
+	expected := `<!-- mdppif expr="version" -->
+<!-- mdppoff
+Version <!-- mdppvar name=version --\><!-- /mdppvar --\>
+
+<!-- mdppcode src=internal/secret.c --\>
+
+    secret
+
+<!-- mdppif expr="true" --\>
+<!-- mdppelse --\>
+<!-- /mdppif --\>
+-->
+<!-- mdppelse -->
+No version.
+<!-- /mdppif -->
+`
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, bytes.NewBufferString(source)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if expected != output.String() {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(expected, output.String()))
+	}
+}
+
+func TestConfig(t *testing.T) {
+	config, err := LoadConfig("misc/config/.mdpp.yaml")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if config.TitlePolicy == nil || *config.TitlePolicy != HeadingOnlyPolicy {
+		t.Fatal("title policy not configured")
+	}
+	input := bytes.NewBufferString(`<!-- mdppindex pattern=misc/docs/*/*.md -->
+<!-- /mdppindex -->
+
+<!-- mdppbadge label=version -->
+<!-- /mdppbadge -->
+`)
+	expected := []byte(`<!-- mdppindex pattern=misc/docs/*/*.md -->
+* [API Reference](misc/docs/api/index.md)
+<!-- /mdppindex -->
+
+<!-- mdppbadge label=version -->
+![version](https://img.shields.io/badge/version-1.0.0-blue)
+<!-- /mdppbadge -->
+`)
+	output := bytes.NewBuffer(nil)
+	if _, _, err := PreprocessWithOptions(output, input, "", "", &Options{Config: config}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+	dir := t.TempDir()
+	for name, test := range map[string]struct {
+		source   string
+		expected string
+	}{
+		".mdpp.yaml": {`variables:
+  version: 1.0.0
+defaults:
+  mdppindex:
+    depth: [1, 2]
+`, ".mdpp.yaml:5: attribute \"depth\" must be a scalar"},
+		".mdpp.toml": {`exec = ["git"]
+
+[directives.mdppdate]
+command = "date +%F"
+`, ".mdpp.toml:4: command not allowed by \"exec\": date"},
+	} {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(test.source), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err := LoadConfig(p)
+		if err == nil || !strings.HasSuffix(err.Error(), test.expected) {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	p := filepath.Join(dir, "exec.yaml")
+	if err := os.WriteFile(p, []byte(`exec: [echo]
+directives:
+  mdppecho:
+    command: echo hello
+`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if config, err = LoadConfig(p); err != nil {
+		t.Fatal(err.Error())
+	}
+	source := `<!-- mdppecho -->
+<!-- /mdppecho -->
+`
+	output = bytes.NewBuffer(nil)
+	if _, _, err := PreprocessWithOptions(output, bytes.NewBufferString(source), "", "", &Options{Config: config}); err == nil || !strings.HasPrefix(err.Error(), "command execution not allowed: mdppecho") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	output = bytes.NewBuffer(nil)
+	if _, _, err := PreprocessWithOptions(output, bytes.NewBufferString(source), "", "", &Options{Config: config, AllowExec: true}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if output.String() != "<!-- mdppecho -->\nhello\n<!-- /mdppecho -->\n" {
+		t.Fatal("Unexpected output", output.String())
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "docs"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(root, "hello.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(root, "docs", "link.txt")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret.md"), []byte("# Secret\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.MkdirAll(filepath.Join(root, "docs", "sub"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(root, "docs", "sub", "page.md"), []byte("# Page\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.Symlink(filepath.Join(dir, "secret.md"), filepath.Join(root, "docs", "sub", "README.md")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(root, "title.tmpl"), []byte(`{{ title "../../secret.md" }}`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	options := &Options{Root: root}
+	input := bytes.NewBufferString("<!-- mdppcode src=../hello.txt -->\n\n    x\n")
+	expected := []byte("<!-- mdppcode src=../hello.txt -->\n\n    hello\n")
+	output := bytes.NewBuffer(nil)
+	if _, _, err := PreprocessWithOptions(output, input, filepath.Join(root, "docs"), "", options); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+	for _, source := range []string{
+		"<!-- mdppcode src=../../secret.txt -->\n\n    x\n",
+		"<!-- mdppcode src=" + filepath.Join(dir, "secret.txt") + " -->\n\n    x\n",
+		"<!-- mdppcode src=link.txt -->\n\n    x\n",
+		"<!-- mdppindex pattern=*.txt -->\n<!-- /mdppindex -->\n",
+		"See <!-- mdpplink href=../../secret.txt --><!-- /mdpplink -->\n",
+		"<!-- mdppindex pattern=sub/p*.md dir-title=true -->\n<!-- /mdppindex -->\n",
+		"<!-- mdpptemplate template=../title.tmpl -->\n<!-- /mdpptemplate -->\n",
+	} {
+		_, _, err := PreprocessWithOptions(bytes.NewBuffer(nil), bytes.NewBufferString(source), filepath.Join(root, "docs"), "", options)
+		if !errors.Is(err, ErrOutsideRoot) {
+			t.Fatalf("Unexpected error: %v: %s", err, source)
+		}
+	}
+}
+
+func TestCodeFence(t *testing.T) {
+	input := bytes.NewBufferString(`<!-- mdppcode src=misc/data/example.markdown lang=auto -->
+
+` + "```" + `
+outdated
+` + "```" + `
+
+<!-- mdppcode src=misc/hello.c fence=true lang=auto -->
+
+    outdated
+
+* Item
+
+  <!-- mdppcode src=misc/hello.c lang=cpp -->
+
+      outdated
+
+<!-- mdppcode src=misc/hello.c -->
+~~~ c {.numberLines}
+~~~
+`)
+	expected := []byte(`<!-- mdppcode src=misc/data/example.markdown lang=auto -->
+
+` + "````" + `markdown
+Example:
+
+` + "```" + `sh
+echo hello
+` + "```" + `
+` + "````" + `
+
+<!-- mdppcode src=misc/hello.c fence=true lang=auto -->
+
+` + "```" + `c
+#include <stdio.h>
+
+int main (int argc, char** argv) {
+	printf("Hello!\n");
+}
+` + "```" + `
+
+* Item
+
+  <!-- mdppcode src=misc/hello.c lang=cpp -->
+
+  ` + "```" + `cpp
+  #include <stdio.h>
+  
+  int main (int argc, char** argv) {
+  	printf("Hello!\n");
+  }
+  ` + "```" + `
+
+<!-- mdppcode src=misc/hello.c -->
+~~~ c {.numberLines}
+#include <stdio.h>
+
+int main (int argc, char** argv) {
+	printf("Hello!\n");
+}
+~~~
+`)
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, input); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+}
+
+func TestCodeFenceInBlockQuote(t *testing.T) {
+	input := bytes.NewBufferString(`<!-- mdppcode src=misc/hello.c -->
+
+> ` + "```" + `c
+> outdated
+> ` + "```" + `
+
+` + "```" + `
+unrelated
+` + "```" + `
+`)
+	expected := []byte(`<!-- mdppcode src=misc/hello.c -->
+
+> ` + "```" + `c
+> #include <stdio.h>
+> 
+> int main (int argc, char** argv) {
+> 	printf("Hello!\n");
+> }
+> ` + "```" + `
+
+` + "```" + `
+unrelated
+` + "```" + `
+`)
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, input); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+	input = bytes.NewBufferString("<!-- mdppcode src=misc/hello.c -->\n\n> ```\n> ```\n")
+	if err := PreprocessWithoutDir(bytes.NewBuffer(nil), input); err == nil || !strings.HasPrefix(err.Error(), "fence of the code block not found") {
+		t.Fatal("not expected error", err)
+	}
+}
+
+func TestCodeOptions(t *testing.T) {
+	input := bytes.NewBufferString(`* Item
+
+  <!-- mdppcode src=misc/data/region.py dedent=true tab-width=4 trim=true -->
+
+      outdated
+
+* Item
+
+  <!-- mdppcode src=misc/data/region.py tab-width=2 -->
+
+      outdated
+`)
+	expected := []byte(`* Item
+
+  <!-- mdppcode src=misc/data/region.py dedent=true tab-width=4 trim=true -->
+
+      if ok:
+          return x  
+      else:
+
+          return y
+
+* Item
+
+  <!-- mdppcode src=misc/data/region.py tab-width=2 -->
+
+          if ok:
+            return x  
+          else:
+      
+            return y
+`)
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, input); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+}
+
+func TestCodeRevision(t *testing.T) {
+	dir := t.TempDir()
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %s", strings.Join(args, " "), output)
+		}
+	}
+	git("init", "-q")
+	if err := os.MkdirAll(filepath.Join(dir, "src"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	p := filepath.Join(dir, "src", "hello.txt")
+	if err := os.WriteFile(p, []byte("before\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	git("add", ".")
+	git("commit", "-q", "-m", "before")
+	git("tag", "v1")
+	if err := os.WriteFile(p, []byte("after\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	input := bytes.NewBufferString(`<!-- mdppcode src=src/hello.txt rev=v1 -->
+
+    x
+
+<!-- mdppcode src=src/hello.txt -->
+
+    x
+
+<!-- mdppdiff src=src/hello.txt old-rev=v1 -->
+
+    x
+`)
+	expected := []byte(`<!-- mdppcode src=src/hello.txt rev=v1 -->
+
+    before
+
+<!-- mdppcode src=src/hello.txt -->
+
+    after
+
+<!-- mdppdiff src=src/hello.txt old-rev=v1 -->
+
+` + "```" + `diff
+--- v1:src/hello.txt
++++ src/hello.txt
+@@ -1 +1 @@
+-before
++after
+` + "```" + `
+`)
+	output := bytes.NewBuffer(nil)
+	if _, _, err := Preprocess(output, input, dir, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+	input = bytes.NewBufferString("<!-- mdppcode src=src/none.txt rev=v1 -->\n\n    x\n")
+	if _, _, err := Preprocess(bytes.NewBuffer(nil), input, dir, ""); err == nil || !strings.Contains(err.Error(), "src/none.txt at v1") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, source := range []string{
+		"<!-- mdppcode src=src/hello.txt rev=--output=x -->\n\n    x\n",
+		"<!-- mdppdiff src=src/hello.txt old-rev=v1:src -->\n\n    x\n",
+	} {
+		_, _, err := Preprocess(bytes.NewBuffer(nil), bytes.NewBufferString(source), dir, "")
+		if err == nil || !strings.HasPrefix(err.Error(), "invalid revision") {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	// The directory of the file need not exist in the working tree
+	git("rm", "-q", "-r", "-f", "src")
+	input = bytes.NewBufferString("<!-- mdppcode src=src/hello.txt rev=v1 -->\n\n    x\n")
+	output = bytes.NewBuffer(nil)
+	if _, _, err := Preprocess(output, input, dir, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.HasSuffix(output.String(), "\n    before\n") {
+		t.Fatal("Unexpected output", output.String())
+	}
+}
+
+func TestDiff(t *testing.T) {
+	input := bytes.NewBufferString(`<!-- mdppdiff old=misc/data/old.yaml new=misc/data/new.yaml context=1 -->
+
+    outdated
+
+* Item
+
+  <!-- mdppdiff old=misc/data/old.yaml new=misc/data/old.yaml -->
+  ` + "```" + `
+  outdated
+  ` + "```" + `
+`)
+	expected := []byte(`<!-- mdppdiff old=misc/data/old.yaml new=misc/data/new.yaml context=1 -->
+
+` + "```" + `diff
+--- misc/data/old.yaml
++++ misc/data/new.yaml
+@@ -1,3 +1,3 @@
+ name: mdpp
+-version: 1.0
++version: 1.1
+ features:
+@@ -5 +5,2 @@
+   - code
++  - diff
+` + "```" + `
+
+* Item
+
+  <!-- mdppdiff old=misc/data/old.yaml new=misc/data/old.yaml -->
+  ` + "```" + `diff
+  ` + "```" + `
+`)
+	output := bytes.NewBuffer(nil)
+	if err := PreprocessWithoutDir(output, input); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Compare(expected, output.Bytes()) != 0 {
+		t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(string(expected), output.String()))
+	}
+	for _, test := range []struct {
+		a        []string
+		b        []string
+		expected string
+	}{
+		{nil, []string{"a", "b"}, "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{[]string{"a", "b"}, []string{"c"}, "--- a\n+++ b\n@@ -1,2 +1 @@\n-a\n-b\n+c\n"},
+	} {
+		output := bytes.NewBuffer(nil)
+		if err := writeUnifiedDiff(output, "a", "b", test.a, test.b, 3, ""); err != nil {
+			t.Fatal(err.Error())
+		}
+		if output.String() != test.expected {
+			t.Fatalf(`Unmatched:
+
+%s`, diff.LineDiff(test.expected, output.String()))
+		}
+	}
+	// Too many edits replace the lines as a whole
+	a, b := []string{"head"}, []string{"head"}
+	for i := 0; i < maxDiffEdits; i++ {
+		a, b = append(a, "a"+strconv.Itoa(i)), append(b, "b"+strconv.Itoa(i))
+	}
+	a, b = append(a, "tail"), append(b, "tail")
+	output = bytes.NewBuffer(nil)
+	if err := writeUnifiedDiff(output, "a", "b", a, b, 3, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	header := fmt.Sprintf("--- a\n+++ b\n@@ -1,%d +1,%d @@\n head\n-a0\n", len(a), len(b))
+	if !strings.HasPrefix(output.String(), header) || !strings.HasSuffix(output.String(), fmt.Sprintf("\n+b%d\n tail\n", maxDiffEdits-1)) {
+		t.Fatal("Unexpected diff")
+	}
+}
@@ -1,6 +1,52 @@
 package mdpp
 
-import "log"
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// mdppAttributes are the attributes of a MDPP command such as
+// `<!-- mdppindex pattern=docs/*.md exclude="docs/drafts docs/old" -->`.
+type mdppAttributes map[string]string
+
+func (attrs mdppAttributes) getString(key string, defaultValue string) string {
+	if value, ok := attrs[key]; ok {
+		return value
+	}
+	return defaultValue
+}
+
+func (attrs mdppAttributes) getBool(key string, defaultValue bool) (bool, error) {
+	value, ok := attrs[key]
+	if !ok {
+		return defaultValue, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return defaultValue, fmt.Errorf("invalid boolean value of attribute \"%s\": %s", key, value)
+	}
+	return b, nil
+}
+
+func (attrs mdppAttributes) getInt(key string, defaultValue int) (int, error) {
+	value, ok := attrs[key]
+	if !ok {
+		return defaultValue, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return defaultValue, fmt.Errorf("invalid integer value of attribute \"%s\": %s", key, value)
+	}
+	return i, nil
+}
+
+// getFields returns the whitespace-separated values of the attribute.
+func (attrs mdppAttributes) getFields(key string) []string {
+	return strings.Fields(attrs[key])
+}
 
 type mdppElem struct {
 	depth int
@@ -22,14 +68,65 @@ func (elem *mdppElem) Depth() int {
 	return elem.depth
 }
 
+// mdppCodeFiller is a command which fills the following code block.
+type mdppCodeFiller interface {
+	mdppElemMethods
+	writeCode(writer io.Writer, indent string) error
+	getCodeFence() *codeFence
+}
+
+var _ mdppCodeFiller = (*mdppCodeElem)(nil)
+var _ mdppCodeFiller = (*mdppTreeElem)(nil)
+var _ mdppCodeFiller = (*mdppDiffElem)(nil)
+
 type mdppLinkElem struct {
 	mdppElem
 	href string
 }
 
+type mdppVarElem struct {
+	mdppElem
+	name string
+}
+
+func (elem *mdppVarElem) Name() string {
+	return "mdppvar"
+}
+
 type mdppCodeElem struct {
 	mdppElem
 	filepath string
+	codeFence
+	codeOptions
+}
+
+func newMdppCodeElem(elem mdppElem, attrs mdppAttributes) (*mdppCodeElem, error) {
+	src, ok := attrs["src"]
+	if !ok {
+		return nil, fmt.Errorf("attribute \"src\" required")
+	}
+	fence, err := newCodeFence(attrs, inferLanguage(src))
+	if err != nil {
+		return nil, err
+	}
+	dedent, err := attrs.getBool("dedent", false)
+	if err != nil {
+		return nil, err
+	}
+	tabWidth, err := attrs.getInt("tab-width", 0)
+	if err != nil {
+		return nil, err
+	}
+	trim, err := attrs.getBool("trim", false)
+	if err != nil {
+		return nil, err
+	}
+	if rev, ok := attrs["rev"]; ok {
+		if err := checkRevision(rev); err != nil {
+			return nil, err
+		}
+	}
+	return &mdppCodeElem{elem, src, fence, codeOptions{dedent, tabWidth, trim, attrs["rev"]}}, nil
 }
 
 func (elem *mdppLinkElem) Name() string {
@@ -40,11 +137,340 @@ func (elem *mdppCodeElem) Name() string {
 	return "mdppcode"
 }
 
+func (elem *mdppCodeElem) writeCode(writer io.Writer, indent string) error {
+	return writeFileWithIndent(writer, elem.filepath, indent, &elem.codeOptions)
+}
+
+func (elem *mdppCodeElem) getCodeFence() *codeFence {
+	return &elem.codeFence
+}
+
+type mdppCsvElem struct {
+	mdppElem
+	src string
+	csvOptions
+}
+
+func newMdppCsvElem(elem mdppElem, attrs mdppAttributes) (*mdppCsvElem, error) {
+	src, ok := attrs["src"]
+	if !ok {
+		return nil, fmt.Errorf("attribute \"src\" required")
+	}
+	header, err := attrs.getBool("header", true)
+	if err != nil {
+		return nil, err
+	}
+	delimiter, err := parseCsvDelimiter(attrs["delimiter"])
+	if err != nil {
+		return nil, err
+	}
+	return &mdppCsvElem{elem, src, csvOptions{
+		columns:   attrs["columns"],
+		align:     attrs["align"],
+		header:    header,
+		delimiter: delimiter,
+	}}, nil
+}
+
+func (elem *mdppCsvElem) Name() string {
+	return "mdppcsv"
+}
+
+type mdppTemplateElem struct {
+	mdppElem
+	template string
+	data     string
+}
+
+func newMdppTemplateElem(elem mdppElem, attrs mdppAttributes) (*mdppTemplateElem, error) {
+	template, ok := attrs["template"]
+	if !ok {
+		return nil, fmt.Errorf("attribute \"template\" required")
+	}
+	return &mdppTemplateElem{elem, template, attrs["data"]}, nil
+}
+
+func (elem *mdppTemplateElem) Name() string {
+	return "mdpptemplate"
+}
+
+type mdppIfElem struct {
+	mdppElem
+	condition bool
+	// Removes the disabled branch instead of commenting it out
+	remove bool
+	// Offsets in the output where the branches start and the else line ends
+	thenStart int
+	elseStart int
+	elseEnd   int
+}
+
+// isOff reports whether the branch being read is disabled.
+func (elem *mdppIfElem) isOff() bool {
+	return elem.condition == (elem.elseStart >= 0)
+}
+
+func newMdppIfElem(elem mdppElem, attrs mdppAttributes, lookup lookupFunc) (*mdppIfElem, error) {
+	s, ok := attrs["expr"]
+	if !ok {
+		return nil, fmt.Errorf("attribute \"expr\" required")
+	}
+	expr, err := parseExpression(s)
+	if err != nil {
+		return nil, err
+	}
+	mode := attrs.getString("mode", "comment")
+	if mode != "comment" && mode != "remove" {
+		return nil, fmt.Errorf("unknown mode: %s", mode)
+	}
+	return &mdppIfElem{
+		mdppElem:  elem,
+		condition: isTruthy(expr.evaluate(lookup)),
+		remove:    mode == "remove",
+		elseStart: -1,
+	}, nil
+}
+
+func (elem *mdppIfElem) Name() string {
+	return "mdppif"
+}
+
+type mdppCustomElem struct {
+	mdppElem
+	name      string
+	directive *Directive
+	attrs     mdppAttributes
+}
+
+func (elem *mdppCustomElem) Name() string {
+	return elem.name
+}
+
+type mdppDiffElem struct {
+	mdppElem
+	oldPath string
+	oldRev  string
+	newPath string
+	newRev  string
+	// Lines of context
+	context int
+	codeFence
+}
+
+func newMdppDiffElem(elem mdppElem, attrs mdppAttributes) (*mdppDiffElem, error) {
+	src := attrs["src"]
+	oldPath, newPath := attrs.getString("old", src), attrs.getString("new", src)
+	if oldPath == "" || newPath == "" {
+		return nil, fmt.Errorf("attributes \"old\" and \"new\", or \"src\" required")
+	}
+	context, err := attrs.getInt("context", 3)
+	if err != nil {
+		return nil, err
+	}
+	if context < 0 {
+		return nil, fmt.Errorf("negative context")
+	}
+	fence, err := newCodeFence(attrs, "diff")
+	if err != nil {
+		return nil, err
+	}
+	if fence.lang == "" {
+		fence.lang = "diff"
+	}
+	for _, key := range []string{"old-rev", "new-rev"} {
+		if err := checkRevision(attrs[key]); err != nil {
+			return nil, err
+		}
+	}
+	return &mdppDiffElem{elem, oldPath, attrs["old-rev"], newPath, attrs["new-rev"], context, fence}, nil
+}
+
+func (elem *mdppDiffElem) Name() string {
+	return "mdppdiff"
+}
+
+func (elem *mdppDiffElem) writeCode(writer io.Writer, indent string) error {
+	return writeDiff(writer, elem, indent)
+}
+
+func (elem *mdppDiffElem) getCodeFence() *codeFence {
+	return &elem.codeFence
+}
+
+type mdppTreeElem struct {
+	mdppElem
+	dir string
+	treeOptions
+	codeFence
+}
+
+func newMdppTreeElem(elem mdppElem, attrs mdppAttributes) (*mdppTreeElem, error) {
+	depth, err := attrs.getInt("depth", 0)
+	if err != nil {
+		return nil, err
+	}
+	dirsOnly, err := attrs.getBool("dirs-only", false)
+	if err != nil {
+		return nil, err
+	}
+	skipHidden, err := attrs.getBool("skip-hidden", true)
+	if err != nil {
+		return nil, err
+	}
+	fence, err := newCodeFence(attrs, "text")
+	if err != nil {
+		return nil, err
+	}
+	return &mdppTreeElem{elem, attrs.getString("dir", "."), treeOptions{
+		depth:      depth,
+		exclude:    attrs.getFields("exclude"),
+		dirsOnly:   dirsOnly,
+		skipHidden: skipHidden,
+		comments:   attrs["comments"],
+	}, fence}, nil
+}
+
+func (elem *mdppTreeElem) Name() string {
+	return "mdpptree"
+}
+
+func (elem *mdppTreeElem) writeCode(writer io.Writer, indent string) error {
+	return writeTree(writer, elem.dir, &elem.treeOptions, indent)
+}
+
+func (elem *mdppTreeElem) getCodeFence() *codeFence {
+	return &elem.codeFence
+}
+
 type mdppIndexElem struct {
 	mdppElem
 	pattern string
+	globOptions
+	// Levels of the nested lists. Not limited if zero.
+	depth int
+	// Labels directories with the titles of their README.md or index.md
+	dirTitle bool
+	sortKey  string
+	reverse  bool
+	// Condition on the metadata of the files to list
+	where expression
+	// "tree", "flat", "numbered", "table" or "definition"
+	layout           string
+	columns          []indexColumn
+	descriptionField string
+	// Metadata field to group the files by
+	group string
+	// "asc", "desc" or "first" (in the order of the first files)
+	groupOrder string
+	// Label of the files without the field
+	groupOther string
+	// Level of the headings of the groups, or nested lists if zero
+	groupHeading int
+	offset       int
+	// Maximum number of the files to list. Not limited if zero.
+	limit int
+	// Link to the full index shown when files are omitted by the limit
+	more      string
+	moreLabel string
+}
+
+func newMdppIndexElem(elem mdppElem, attrs mdppAttributes, defaultLayout string) (*mdppIndexElem, error) {
+	pattern, ok := attrs["pattern"]
+	if !ok {
+		return nil, fmt.Errorf("attribute \"pattern\" required")
+	}
+	skipHidden, err := attrs.getBool("skip-hidden", false)
+	if err != nil {
+		return nil, err
+	}
+	depth, err := attrs.getInt("depth", 0)
+	if err != nil {
+		return nil, err
+	}
+	dirTitle, err := attrs.getBool("dir-title", false)
+	if err != nil {
+		return nil, err
+	}
+	reverse, err := attrs.getBool("reverse", false)
+	if err != nil {
+		return nil, err
+	}
+	var where expression
+	if s, ok := attrs["where"]; ok {
+		if where, err = parseExpression(s); err != nil {
+			return nil, err
+		}
+	}
+	layout := attrs.getString("layout", defaultLayout)
+	switch layout {
+	case "tree", "flat", "numbered", "table", "definition":
+	default:
+		return nil, fmt.Errorf("unknown layout: %s", layout)
+	}
+	groupOrder := attrs.getString("group-order", "asc")
+	switch groupOrder {
+	case "asc", "desc", "first":
+	default:
+		return nil, fmt.Errorf("unknown group order: %s", groupOrder)
+	}
+	groupHeading, err := attrs.getInt("group-heading", 0)
+	if err != nil {
+		return nil, err
+	}
+	if groupHeading < 0 || groupHeading > 6 {
+		return nil, fmt.Errorf("invalid heading level: %d", groupHeading)
+	}
+	offset, err := attrs.getInt("offset", 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := attrs.getInt("limit", 0)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || limit < 0 {
+		return nil, fmt.Errorf("negative offset or limit")
+	}
+	columns, err := parseIndexColumns(attrs.getString("columns", "title"))
+	if err != nil {
+		return nil, err
+	}
+	return &mdppIndexElem{
+		mdppElem: elem,
+		pattern:  pattern,
+		globOptions: globOptions{
+			exclude:    attrs.getFields("exclude"),
+			skipHidden: skipHidden,
+		},
+		depth:            depth,
+		dirTitle:         dirTitle,
+		sortKey:          attrs["sort"],
+		reverse:          reverse,
+		where:            where,
+		layout:           layout,
+		columns:          columns,
+		descriptionField: attrs.getString("description", "description"),
+		group:            attrs["group"],
+		groupOrder:       groupOrder,
+		groupOther:       attrs.getString("group-other", "Others"),
+		groupHeading:     groupHeading,
+		offset:           offset,
+		limit:            limit,
+		more:             attrs["more"],
+		moreLabel:        attrs.getString("more-label", "More…"),
+	}, nil
 }
 
 func (elem *mdppIndexElem) Name() string {
 	return "mdppindex"
 }
+
+// mdppBacklinksElem lists the documents linking to the including document. It
+// takes the same attributes as mdppindex.
+type mdppBacklinksElem struct {
+	mdppIndexElem
+}
+
+func (elem *mdppBacklinksElem) Name() string {
+	return "mdppbacklinks"
+}
@@ -0,0 +1,5 @@
+		if ok:
+			return x  
+		else:
+
+			return y
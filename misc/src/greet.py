@@ -0,0 +1,4 @@
+#!/usr/bin/env python3
+# Greeting script
+
+print("Hello!")
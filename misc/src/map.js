@@ -0,0 +1 @@
+const map = { title: "Not a title" };
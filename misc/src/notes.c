@@ -0,0 +1,7 @@
+/*
+ * Notes on C
+ */
+
+int main(void) {
+	return 0;
+}
@@ -0,0 +1,72 @@
+package mdpp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrOutsideRoot is the error when a file outside the root directory is to be
+// read.
+var ErrOutsideRoot = errors.New("path outside the root directory")
+
+// sandbox restricts the files to read to the ones under the root directory.
+// A nil sandbox does not restrict any.
+type sandbox struct {
+	// Absolute path of the root with the symbolic links resolved
+	root string
+}
+
+func newSandbox(root string) (*sandbox, error) {
+	if root == "" {
+		return nil, nil
+	}
+	resolved, err := resolvePath(root)
+	if err != nil {
+		return nil, err
+	}
+	return &sandbox{resolved}, nil
+}
+
+// resolvePath returns the absolute path with the symbolic links resolved. The
+// part which does not exist is left as it is.
+func resolvePath(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(absPath)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(absPath)
+		if parent == absPath {
+			return filepath.Join(absPath, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(absPath), rest)
+		absPath = parent
+	}
+}
+
+// check returns ErrOutsideRoot if the path escapes the root.
+func (sb *sandbox) check(path string) error {
+	if sb == nil {
+		return nil
+	}
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(sb.root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%w: %s", ErrOutsideRoot, path)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package mdpp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// loadDataFile reads the YAML, JSON or TOML file by its extension.
+func loadDataFile(path string) (interface{}, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseData(source, path)
+}
+
+func parseData(source []byte, path string) (interface{}, error) {
+	var data interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(source, &data); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		data = normalizeYamlValue(data)
+	case ".json":
+		if err := json.Unmarshal(source, &data); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+	case ".toml":
+		var fields map[string]interface{}
+		if _, err := toml.Decode(string(source), &fields); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		data = fields
+	default:
+		return nil, fmt.Errorf("unknown data file type: %s", path)
+	}
+	return data, nil
+}
+
+var reMarkdownSpecial = regexp.MustCompile("[\\\\`*_\\[\\]<>|~]")
+var reMarkdownLineStart = regexp.MustCompile(`^(\s*)([#+-]|[0-9]+[.)])`)
+
+// escapeMarkdown escapes the characters which can be taken as Markdown
+// inline markup, and the ones which start a block at the head.
+func escapeMarkdown(s string) string {
+	s = reMarkdownSpecial.ReplaceAllString(s, "\\$0")
+	if match := reMarkdownLineStart.FindStringSubmatchIndex(s); match != nil {
+		i := match[5] - 1
+		s = s[:i] + "\\" + s[i:]
+	}
+	return s
+}
+
+// markdownLink makes an inline link with the text escaped and the
+// destination quoted if needed.
+func markdownLink(text interface{}, destination interface{}) string {
+	href := metadataString(destination)
+	if strings.ContainsAny(href, " ()<>") {
+		href = (&url.URL{Path: href}).EscapedPath()
+		href = strings.NewReplacer("(", "%28", ")", "%29").Replace(href)
+	}
+	// The text is not at the head of a line
+	label := reMarkdownSpecial.ReplaceAllString(metadataString(text), "\\$0")
+	return "[" + label + "](" + href + ")"
+}
+
+// markdownCode makes an inline code span with enough backticks.
+func markdownCode(value interface{}) string {
+	s := metadataString(value)
+	fence := "`"
+	for strings.Contains(s, fence) {
+		fence += "`"
+	}
+	if strings.HasPrefix(s, "`") || strings.HasSuffix(s, "`") {
+		s = " " + s + " "
+	}
+	return fence + s + fence
+}
+
+// getTemplateFuncs returns the functions available in the templates, which
+// read no file outside the sandbox.
+func getTemplateFuncs(titlePolicy TitlePolicy, sb *sandbox) template.FuncMap {
+	return template.FuncMap{
+		"mdescape": func(value interface{}) string {
+			return escapeMarkdown(metadataString(value))
+		},
+		"mdlink": markdownLink,
+		"mdcode": markdownCode,
+		"mdcell": func(value interface{}) string {
+			return escapeTableCell(metadataString(value))
+		},
+		"join": func(separator string, value interface{}) string {
+			items, ok := value.([]interface{})
+			if !ok {
+				return metadataString(value)
+			}
+			var strs []string
+			for _, item := range items {
+				strs = append(strs, metadataString(item))
+			}
+			return strings.Join(strs, separator)
+		},
+		"title": func(path string) (string, error) {
+			if err := sb.check(path); err != nil {
+				return "", err
+			}
+			return GetFileTitle(path, titlePolicy), nil
+		},
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+		"trim":  strings.TrimSpace,
+	}
+}
+
+// writeTemplate renders the template file with the data and writes it with
+// the indent.
+func writeTemplate(writer io.Writer, templatePath string, dataPath string, indent string, titlePolicy TitlePolicy, sb *sandbox) error {
+	var data interface{}
+	if dataPath != "" {
+		var err error
+		if data, err = loadDataFile(dataPath); err != nil {
+			return err
+		}
+	}
+	return executeTemplateFile(writer, templatePath, data, getTemplateFuncs(titlePolicy, sb), indent)
+}
+
+func executeTemplateFile(writer io.Writer, templatePath string, data interface{}, funcs template.FuncMap, indent string) error {
+	source, err := os.ReadFile(templatePath)
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.New(filepath.Base(templatePath)).Funcs(funcs).
+		Option("missingkey=zero").Parse(string(source))
+	if err != nil {
+		return err
+	}
+	output := bytes.NewBuffer(nil)
+	if err := tmpl.Execute(output, data); err != nil {
+		return err
+	}
+	return writeIndentedText(writer, output.String(), indent)
+}
+
+// writeIndentedText writes the text with the indent on the non-empty lines,
+// ending with a newline if not empty.
+func writeIndentedText(writer io.Writer, text string, indent string) error {
+	text = strings.TrimRight(text, "\n")
+	if text == "" {
+		return nil
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if line != "" {
+			line = indent + line
+		}
+		if _, err := fmt.Fprintln(writer, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,11 +1,21 @@
 package mdpp
 
 import (
-	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	mtext "github.com/yuin/goldmark/text"
+	"gopkg.in/yaml.v2"
 )
 
 type MarkdownStyle int8
@@ -15,9 +25,116 @@ const (
 	MultiMarkdownStyle
 	PandocTitleBlockStyle
 	YamlMetadataBlockStyle
+	TomlFrontMatterStyle
+	JsonFrontMatterStyle
+)
+
+var markdownStyleNames = []string{
+	UnknownStyle:           "unknown",
+	MultiMarkdownStyle:     "multimarkdown",
+	PandocTitleBlockStyle:  "pandoc",
+	YamlMetadataBlockStyle: "yaml",
+	TomlFrontMatterStyle:   "toml",
+	JsonFrontMatterStyle:   "json",
+}
+
+func (style MarkdownStyle) String() string {
+	if int(style) < len(markdownStyleNames) {
+		return markdownStyleNames[style]
+	}
+	return fmt.Sprintf("MarkdownStyle(%d)", int(style))
+}
+
+// Metadata holds the fields of a metadata block. Keys are lower-cased and the
+// values are strings, numbers, booleans, lists ([]interface{}) or nested maps
+// (map[string]interface{}).
+type Metadata map[string]interface{}
+
+// Lookup returns the field. Fields in nested maps can be specified with a
+// dotted key such as "params.weight".
+func (metadata Metadata) Lookup(key string) (interface{}, bool) {
+	names := strings.Split(key, ".")
+	value, ok := metadata[strings.ToLower(names[0])]
+	for _, name := range names[1:] {
+		if !ok {
+			break
+		}
+		var m map[string]interface{}
+		if m, ok = value.(map[string]interface{}); ok {
+			value, ok = m[name]
+		}
+	}
+	if !ok || value == nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// GetString returns the field as a string, joining lists with ", ".
+func (metadata Metadata) GetString(key string) (string, bool) {
+	value, ok := metadata.Lookup(key)
+	if !ok {
+		return "", false
+	}
+	return metadataString(value), true
+}
+
+func metadataString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			items = append(items, metadataString(item))
+		}
+		return strings.Join(items, ", ")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// TitlePolicy decides where the title of a document is taken from.
+type TitlePolicy int8
+
+const (
+	FrontMatterThenHeadingPolicy TitlePolicy = iota
+	FrontMatterOnlyPolicy
+	HeadingOnlyPolicy
 )
 
+var titlePolicyNames = []string{
+	FrontMatterThenHeadingPolicy: "front-matter-then-heading",
+	FrontMatterOnlyPolicy:        "front-matter-only",
+	HeadingOnlyPolicy:            "heading-only",
+}
+
+func (policy TitlePolicy) String() string {
+	if int(policy) < len(titlePolicyNames) {
+		return titlePolicyNames[policy]
+	}
+	return fmt.Sprintf("TitlePolicy(%d)", int(policy))
+}
+
+// ParseTitlePolicy parses the name of a title policy such as "heading-only".
+func ParseTitlePolicy(name string) (TitlePolicy, error) {
+	for i, s := range titlePolicyNames {
+		if s == name {
+			return TitlePolicy(i), nil
+		}
+	}
+	return FrontMatterThenHeadingPolicy, fmt.Errorf("unknown title policy: %s", name)
+}
+
 func GetMarkdownTitle(path string) string {
+	return GetMarkdownTitleWithPolicy(path, FrontMatterThenHeadingPolicy)
+}
+
+func GetMarkdownTitleWithPolicy(path string, policy TitlePolicy) string {
 	input, err := os.Open(path)
 	if err != nil {
 		return ""
@@ -25,76 +142,486 @@ func GetMarkdownTitle(path string) string {
 	defer func() {
 		_ = input.Close()
 	}()
-	return GetMarkdownTitleSub(input, path)
+	return GetMarkdownTitleSubWithPolicy(input, path, policy)
 }
 
 func GetMarkdownTitleSub(input io.Reader, defaultTitle string) string {
-	title := defaultTitle
-	style := UnknownStyle
-	scanner := bufio.NewScanner(input)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
+	return GetMarkdownTitleSubWithPolicy(input, defaultTitle, FrontMatterThenHeadingPolicy)
+}
+
+// GetMarkdownTitleSubWithPolicy returns the title in the metadata block and/or
+// the first level-1 heading according to the policy, or defaultTitle if not
+// found.
+func GetMarkdownTitleSubWithPolicy(input io.Reader, defaultTitle string, policy TitlePolicy) string {
+	source, err := io.ReadAll(input)
+	if err != nil {
+		return defaultTitle
+	}
+	metadata, _, bodyStart, err := parseMarkdownMetadata(source)
+	if policy != HeadingOnlyPolicy && err == nil {
+		if title, ok := metadata.GetString("title"); ok && title != "" {
+			return title
+		}
+	}
+	if policy != FrontMatterOnlyPolicy {
+		// Comments in the metadata block are not headings
+		if title := getFirstHeading(source[bodyStart:]); title != "" {
+			return title
+		}
+	}
+	return defaultTitle
+}
+
+// getFirstHeading returns the text of the first top-level ATX or Setext
+// heading of level 1.
+func getFirstHeading(source []byte) string {
+	doc := goldmark.New().Parser().Parse(mtext.NewReader(source))
+	for node := doc.FirstChild(); node != nil; node = node.NextSibling() {
+		if heading, ok := node.(*ast.Heading); ok && heading.Level == 1 {
+			return strings.TrimSpace(string(heading.Text(source)))
+		}
+	}
+	return ""
+}
+
+// GetMarkdownMetadata reads the metadata block of the Markdown file.
+func GetMarkdownMetadata(path string) (Metadata, MarkdownStyle, error) {
+	input, err := os.Open(path)
+	if err != nil {
+		return nil, UnknownStyle, err
+	}
+	defer func() {
+		_ = input.Close()
+	}()
+	return GetMarkdownMetadataSub(input)
+}
+
+// GetMarkdownMetadataSub parses the metadata block at the head of the input.
+// YAML metadata blocks, TOML (`+++`) and JSON front matter, Pandoc title
+// blocks and MultiMarkdown metadata are supported. An empty Metadata and
+// UnknownStyle are returned if there is none.
+func GetMarkdownMetadataSub(input io.Reader) (Metadata, MarkdownStyle, error) {
+	source, err := io.ReadAll(input)
+	if err != nil {
+		return nil, UnknownStyle, err
+	}
+	metadata, style, _, err := parseMarkdownMetadata(source)
+	return metadata, style, err
+}
+
+// parseMarkdownMetadata parses the metadata block and returns the offset of
+// the body after it as well, which is given even if the block is invalid.
+func parseMarkdownMetadata(source []byte) (Metadata, MarkdownStyle, int, error) {
+	lines := splitLines(source)
+	i := 0
+	for i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+		i++
+	}
+	if i == len(lines) {
+		return Metadata{}, UnknownStyle, 0, nil
+	}
+	var metadata Metadata
+	style, n := UnknownStyle, 0
+	var err error
+	line := strings.TrimSpace(lines[i])
+	switch {
+	case line == "---":
+		metadata, style, n, err = parseYamlMetadata(lines[i+1:])
+	case line == "+++":
+		metadata, style, n, err = parseTomlFrontMatter(lines[i+1:])
+	case line[0] == '{':
+		metadata, style, n, err = parseJsonFrontMatter(lines[i:])
+	case line[0] == '%':
+		metadata, n = parsePandocTitleBlock(lines[i:])
+		style = PandocTitleBlockStyle
+	case reMultiMarkdownKey.MatchString(lines[i]):
+		metadata, n = parseMultiMarkdownMetadata(lines[i:])
+		style = MultiMarkdownStyle
+	default:
+		metadata = Metadata{}
+	}
+	if n == 0 {
+		return metadata, style, 0, err
+	}
+	end := i + n
+	if line == "---" || line == "+++" {
+		// The opening line
+		end++
+	}
+	bodyStart := len(source)
+	if ranges := getLineRanges(source); end < len(ranges) {
+		bodyStart = ranges[end].start
+	}
+	return metadata, style, bodyStart, err
+}
+
+// splitLines splits the source into lines without line terminators.
+func splitLines(source []byte) []string {
+	source = bytes.TrimSuffix(source, []byte("\n"))
+	if len(source) == 0 {
+		return nil
+	}
+	lines := strings.Split(string(source), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
+
+// parseYamlMetadata parses the lines after the opening line and returns the
+// number of the lines up to the closing line as well, or 0 if not closed.
+func parseYamlMetadata(lines []string) (Metadata, MarkdownStyle, int, error) {
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line != "---" && line != "..." {
 			continue
 		}
-		if style == UnknownStyle {
-			if line == "---" {
-				style = YamlMetadataBlockStyle
-				continue
-			} else if line[0] == '%' {
-				style = PandocTitleBlockStyle
-			} else if strings.ContainsRune(line, ':') {
-				style = MultiMarkdownStyle
-			} else {
-				continue
-			}
+		var fields map[string]interface{}
+		if err := yaml.Unmarshal([]byte(strings.Join(lines[:i], "\n")), &fields); err != nil {
+			return nil, YamlMetadataBlockStyle, i + 1, err
+		}
+		for key, value := range fields {
+			fields[key] = normalizeYamlValue(value)
+		}
+		return newMetadata(fields), YamlMetadataBlockStyle, i + 1, nil
+	}
+	// Not closed, so this is not a metadata block
+	return Metadata{}, UnknownStyle, 0, nil
+}
+
+func newMetadata(fields map[string]interface{}) Metadata {
+	metadata := Metadata{}
+	for key, value := range fields {
+		key = strings.ToLower(key)
+		if _, ok := metadata[key]; !ok {
+			metadata[key] = value
+		}
+	}
+	return metadata
+}
+
+func parseTomlFrontMatter(lines []string) (Metadata, MarkdownStyle, int, error) {
+	for i, line := range lines {
+		if strings.TrimSpace(line) != "+++" {
+			continue
+		}
+		var fields map[string]interface{}
+		if _, err := toml.Decode(strings.Join(lines[:i], "\n"), &fields); err != nil {
+			return nil, TomlFrontMatterStyle, i + 1, err
+		}
+		return newMetadata(fields), TomlFrontMatterStyle, i + 1, nil
+	}
+	return Metadata{}, UnknownStyle, 0, nil
+}
+
+// JSON front matter is an object at the head of the document as Hugo does.
+// The document does not have any if the head does not parse as an object,
+// such as a line of Hugo or Liquid templates ("{{ ... }}" or "{% ... %}").
+func parseJsonFrontMatter(lines []string) (Metadata, MarkdownStyle, int, error) {
+	var value interface{}
+	text := strings.Join(lines, "\n")
+	decoder := json.NewDecoder(strings.NewReader(text))
+	if err := decoder.Decode(&value); err != nil {
+		return Metadata{}, UnknownStyle, 0, nil
+	}
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return Metadata{}, UnknownStyle, 0, nil
+	}
+	n := strings.Count(text[:decoder.InputOffset()], "\n") + 1
+	return newMetadata(fields), JsonFrontMatterStyle, n, nil
+}
+
+// normalizeYamlValue converts the maps decoded by yaml.v2 into ones with
+// string keys so that they can be handled (and marshaled to JSON) uniformly.
+func normalizeYamlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for key, item := range v {
+			m[fmt.Sprint(key)] = normalizeYamlValue(item)
 		}
-		if style == YamlMetadataBlockStyle {
-			if line == "---" {
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeYamlValue(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// Pandoc title block: "% title", "% author(s)" and "% date" lines which can be
+// continued with lines starting with a space.
+func parsePandocTitleBlock(lines []string) (Metadata, int) {
+	var fields [][]string
+	n := 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, "%") {
+			if len(fields) == 3 {
 				break
 			}
-			fields := strings.Split(line, ":")
-			if len(fields) >= 2 {
-				key := strings.TrimSpace(fields[0])
-				if strings.ToLower(key) == "title" {
-					title = strings.TrimFunc(fields[1], func(r rune) bool {
-						return r == '"' || r == '\'' || unicode.IsSpace(r)
-					})
-					break
-				}
+			fields = append(fields, []string{strings.TrimSpace(line[1:])})
+		} else if len(fields) > 0 && strings.HasPrefix(line, " ") && strings.TrimSpace(line) != "" {
+			fields[len(fields)-1] = append(fields[len(fields)-1], strings.TrimSpace(line))
+		} else {
+			break
+		}
+		n++
+	}
+	metadata := Metadata{}
+	for i, field := range fields {
+		switch i {
+		case 0, 2:
+			value := strings.TrimSpace(strings.Join(field, " "))
+			if value == "" {
+				continue
+			}
+			if i == 0 {
+				metadata["title"] = value
+			} else {
+				metadata["date"] = value
 			}
-		} else if style == PandocTitleBlockStyle {
-			title = strings.TrimLeftFunc(line, func(r rune) bool {
-				return r == '%' || unicode.IsSpace(r)
-			})
-			for scanner.Scan() {
-				line = scanner.Text()
-				if strings.HasPrefix(line, " ") {
-					title += line
-				} else {
-					break
+		case 1:
+			var authors []interface{}
+			for _, line := range field {
+				for _, author := range strings.Split(line, ";") {
+					if author = strings.TrimSpace(author); author != "" {
+						authors = append(authors, author)
+					}
 				}
 			}
+			if len(authors) > 0 {
+				metadata["author"] = authors
+			}
+		}
+	}
+	return metadata, n
+}
+
+var reMultiMarkdownKey = regexp.MustCompile(`^([\p{L}\p{N}][-_ \p{L}\p{N}]*):(.*)$`)
+
+// MultiMarkdown metadata: "Key: value" lines up to the first blank line. The
+// value can be continued with indented lines.
+func parseMultiMarkdownMetadata(lines []string) (Metadata, int) {
+	metadata := Metadata{}
+	key := ""
+	n := 0
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+		if match := reMultiMarkdownKey.FindStringSubmatch(line); match != nil {
+			key = strings.ToLower(strings.ReplaceAll(match[1], " ", ""))
+			metadata[key] = trimMetadataValue(match[2])
+		} else if key != "" && (line[0] == ' ' || line[0] == '\t') {
+			value := metadata[key].(string)
+			if value != "" {
+				value += " "
+			}
+			metadata[key] = value + trimMetadataValue(line)
+		} else {
 			break
-		} else if style == MultiMarkdownStyle {
-			if !strings.ContainsRune(line, ':') {
+		}
+		n++
+	}
+	return metadata, n
+}
+
+func trimMetadataValue(s string) string {
+	return strings.TrimFunc(s, func(r rune) bool {
+		return r == '"' || r == '\'' || unicode.IsSpace(r)
+	})
+}
+
+type lineRange struct {
+	start int
+	// The position of the line terminator
+	stop int
+}
+
+func getLineRanges(source []byte) []lineRange {
+	var ranges []lineRange
+	for start := 0; start < len(source); {
+		stop := bytes.IndexByte(source[start:], '\n')
+		next := start + stop + 1
+		if stop < 0 {
+			stop = len(source) - start
+			next = len(source)
+		}
+		stop += start
+		if stop > start && source[stop-1] == '\r' {
+			stop--
+		}
+		ranges = append(ranges, lineRange{start, stop})
+		start = next
+	}
+	return ranges
+}
+
+var (
+	reYamlTitle  = regexp.MustCompile(`^(?i:title)\s*:`)
+	reTomlTitle  = regexp.MustCompile(`^\s*(?i:title|"title"|'title')\s*=`)
+	reTomlKey    = regexp.MustCompile(`^\s*[^#\s\[][^=]*=\s*`)
+	reTomlHeader = regexp.MustCompile(`^\s*\[`)
+)
+
+// tomlValueEnd returns the index of the last line of the value whose key is
+// in the line i, which is after it if the value is a multi-line string.
+func tomlValueEnd(lines []string, i int) (int, error) {
+	value := lines[i][len(reTomlKey.FindString(lines[i])):]
+	for _, delimiter := range []string{`"""`, `'''`} {
+		if !strings.HasPrefix(value, delimiter) {
+			continue
+		}
+		rest := value[len(delimiter):]
+		for last := i; last < len(lines); last++ {
+			if last > i {
+				rest = lines[last]
+			}
+			if strings.Contains(rest, delimiter) {
+				return last, nil
+			}
+		}
+		return 0, fmt.Errorf("unterminated multi-line string at line %d", i+1)
+	}
+	return i, nil
+}
+
+// SetMarkdownTitle returns the source with the title in its metadata block
+// replaced, or inserted if there is none. The style of the metadata block is
+// kept and the rest of the source is preserved as it is. A YAML metadata
+// block is added if the source does not have any.
+func SetMarkdownTitle(source []byte, title string) ([]byte, error) {
+	_, style, err := GetMarkdownMetadataSub(bytes.NewReader(source))
+	if err != nil {
+		return nil, err
+	}
+	title = strings.Join(strings.Fields(title), " ")
+	eol := "\n"
+	if bytes.Contains(source, []byte("\r\n")) {
+		eol = "\r\n"
+	}
+	lines := getLineRanges(source)
+	text := func(i int) string {
+		return string(source[lines[i].start:lines[i].stop])
+	}
+	isContinuation := func(i int) bool {
+		s := text(i)
+		return s != "" && (s[0] == ' ' || s[0] == '\t')
+	}
+	replace := func(first int, last int, s string) []byte {
+		return concatBytes(source[:lines[first].start], []byte(s), source[lines[last].stop:])
+	}
+	insert := func(at int, s string) []byte {
+		position := len(source)
+		if at < len(lines) {
+			position = lines[at].start
+		} else if len(lines) > 0 && lines[len(lines)-1].stop == len(source) {
+			s = eol + s
+		}
+		return concatBytes(source[:position], []byte(s+eol), source[position:])
+	}
+	head := 0
+	for head < len(lines) && strings.TrimSpace(text(head)) == "" {
+		head++
+	}
+	switch style {
+	case YamlMetadataBlockStyle:
+		value, err := yaml.Marshal(title)
+		if err != nil {
+			return nil, err
+		}
+		for i := head + 1; i < len(lines); i++ {
+			line := strings.TrimSpace(text(i))
+			if line == "---" || line == "..." {
 				break
 			}
-			fields := strings.Split(line, ":")
-			if len(fields) >= 2 {
-				key := strings.TrimSpace(fields[0])
-				if strings.ToLower(key) == "title" {
-					title = strings.TrimFunc(fields[1], func(r rune) bool {
-						return r == '"' || r == '\'' || unicode.IsSpace(r)
-					})
-					break
+			if match := reYamlTitle.FindString(text(i)); match != "" {
+				last := i
+				// Block scalars may contain blank lines
+				for next := i + 1; next < len(lines); next++ {
+					if isContinuation(next) {
+						last = next
+					} else if strings.TrimSpace(text(next)) != "" {
+						break
+					}
 				}
-			} else {
+				return replace(i, last, match+" "+strings.TrimSuffix(string(value), "\n")), nil
+			}
+		}
+		return insert(head+1, "title: "+strings.TrimSuffix(string(value), "\n")), nil
+	case TomlFrontMatterStyle:
+		value, err := marshalJsonString(title)
+		if err != nil {
+			return nil, err
+		}
+		var texts []string
+		for i := range lines {
+			texts = append(texts, text(i))
+		}
+		for i := head + 1; i < len(lines); i++ {
+			line := text(i)
+			if strings.TrimSpace(line) == "+++" || reTomlHeader.MatchString(line) {
 				break
 			}
-		} else {
-			return ""
+			if !reTomlKey.MatchString(line) {
+				continue
+			}
+			// Lines in multi-line strings are not keys
+			last, err := tomlValueEnd(texts, i)
+			if err != nil {
+				return nil, err
+			}
+			if match := reTomlTitle.FindString(line); match != "" {
+				return replace(i, last, match+" "+value), nil
+			}
+			i = last
+		}
+		return insert(head+1, "title = "+value), nil
+	case PandocTitleBlockStyle:
+		last := head
+		for last+1 < len(lines) && strings.HasPrefix(text(last+1), " ") && strings.TrimSpace(text(last+1)) != "" {
+			last++
 		}
+		return replace(head, last, "% "+title), nil
+	case MultiMarkdownStyle:
+		for i := head; i < len(lines) && strings.TrimSpace(text(i)) != ""; i++ {
+			if match := reYamlTitle.FindString(text(i)); match != "" {
+				last := i
+				for last+1 < len(lines) && isContinuation(last+1) {
+					last++
+				}
+				return replace(i, last, match+" "+title), nil
+			}
+		}
+		return insert(head, "Title: "+title), nil
+	case UnknownStyle:
+		value, err := yaml.Marshal(title)
+		if err != nil {
+			return nil, err
+		}
+		block := "---" + eol + "title: " + strings.TrimSuffix(string(value), "\n") + eol + "---" + eol
+		return concatBytes([]byte(block), source), nil
+	}
+	return nil, fmt.Errorf("setting the title is not supported for %s metadata", style)
+}
+
+func marshalJsonString(s string) (string, error) {
+	buf := bytes.NewBuffer(nil)
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(s); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+func concatBytes(slices ...[]byte) []byte {
+	var result []byte
+	for _, slice := range slices {
+		result = append(result, slice...)
 	}
-	return title
+	return result
 }
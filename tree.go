@@ -0,0 +1,145 @@
+package mdpp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// treeOptions are the options of mdpptree.
+type treeOptions struct {
+	// Levels below the root to show. Not limited if zero.
+	depth int
+	// Patterns matched against the names and the relative paths
+	exclude    []string
+	dirsOnly   bool
+	skipHidden bool
+	// Sidecar file with "path comment" lines
+	comments string
+}
+
+// treeLine is a line of the tree with the path relative to the root.
+type treeLine struct {
+	text string
+	path string
+}
+
+// readTreeComments reads the lines of paths relative to the root and their
+// comments. Blank lines and lines starting with "#" are ignored.
+func readTreeComments(commentsPath string) (map[string]string, error) {
+	input, err := os.Open(commentsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = input.Close()
+	}()
+	comments := map[string]string{}
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			comments[path.Clean(line[:i])] = strings.TrimSpace(line[i:])
+		}
+	}
+	return comments, scanner.Err()
+}
+
+func isTreeExcluded(rel string, name string, options *treeOptions) bool {
+	if options.skipHidden && strings.HasPrefix(name, ".") {
+		return true
+	}
+	for _, exclude := range options.exclude {
+		if matched, _ := path.Match(exclude, name); matched {
+			return true
+		}
+		if matchSegments(strings.Split(exclude, "/"), strings.Split(rel, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+func collectTreeLines(dir string, rel string, prefix string, level int, options *treeOptions) ([]treeLine, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, filepath.FromSlash(rel)))
+	if err != nil {
+		return nil, err
+	}
+	var children []os.DirEntry
+	for _, entry := range entries {
+		if options.dirsOnly && !entry.IsDir() {
+			continue
+		}
+		if isTreeExcluded(path.Join(rel, entry.Name()), entry.Name(), options) {
+			continue
+		}
+		children = append(children, entry)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Name() < children[j].Name()
+	})
+	var lines []treeLine
+	for i, child := range children {
+		connector, childPrefix := "├── ", "│   "
+		if i == len(children)-1 {
+			connector, childPrefix = "└── ", "    "
+		}
+		childRel := path.Join(rel, child.Name())
+		lines = append(lines, treeLine{prefix + connector + child.Name(), childRel})
+		if child.IsDir() && (options.depth <= 0 || level < options.depth) {
+			childLines, err := collectTreeLines(dir, childRel, prefix+childPrefix, level+1, options)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, childLines...)
+		}
+	}
+	return lines, nil
+}
+
+// writeTree writes the directory tree in the style of tree(1) with the
+// comments aligned.
+func writeTree(writer io.Writer, dir string, options *treeOptions, indent string) error {
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("not a directory: %s", dir)
+	}
+	var comments map[string]string
+	if options.comments != "" {
+		var err error
+		if comments, err = readTreeComments(options.comments); err != nil {
+			return err
+		}
+	}
+	childLines, err := collectTreeLines(dir, "", "", 1, options)
+	if err != nil {
+		return err
+	}
+	lines := append([]treeLine{{filepath.ToSlash(dir), "."}}, childLines...)
+	width := 0
+	for _, line := range lines {
+		if n := utf8.RuneCountInString(line.text); n > width {
+			width = n
+		}
+	}
+	for _, line := range lines {
+		text := line.text
+		if comment, ok := comments[line.path]; ok {
+			text += strings.Repeat(" ", width-utf8.RuneCountInString(text)) + "  # " + comment
+		}
+		if _, err := fmt.Fprintln(writer, indent+text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
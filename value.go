@@ -0,0 +1,107 @@
+package mdpp
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+func isDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
+
+// toNumber converts the metadata value to a number if possible.
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// compareValues compares the metadata values numerically if both are numbers,
+// chronologically if both are times, and naturally as strings otherwise.
+func compareValues(a interface{}, b interface{}) int {
+	if x, ok := toNumber(a); ok {
+		if y, ok := toNumber(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	if x, ok := a.(time.Time); ok {
+		if y, ok := b.(time.Time); ok {
+			switch {
+			case x.Before(y):
+				return -1
+			case x.After(y):
+				return 1
+			}
+			return 0
+		}
+	}
+	return compareNatural(metadataString(a), metadataString(b))
+}
+
+// splitDigits splits the string into runs of digits and non-digits.
+func splitDigits(s string) []string {
+	var chunks []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if i > start && isDigit(s[i]) != isDigit(s[start]) {
+			chunks = append(chunks, s[start:i])
+			start = i
+		}
+	}
+	if start < len(s) {
+		chunks = append(chunks, s[start:])
+	}
+	return chunks
+}
+
+// compareNatural compares the strings treating runs of digits as numbers so
+// that "2-foo" comes before "10-bar".
+func compareNatural(a string, b string) int {
+	x := splitDigits(a)
+	y := splitDigits(b)
+	for i := 0; i < len(x) && i < len(y); i++ {
+		if x[i] == y[i] {
+			continue
+		}
+		if isDigit(x[i][0]) && isDigit(y[i][0]) {
+			m := strings.TrimLeft(x[i], "0")
+			n := strings.TrimLeft(y[i], "0")
+			if len(m) != len(n) {
+				if len(m) < len(n) {
+					return -1
+				}
+				return 1
+			}
+			if m != n {
+				return strings.Compare(m, n)
+			}
+			continue
+		}
+		return strings.Compare(x[i], y[i])
+	}
+	switch {
+	case len(x) < len(y):
+		return -1
+	case len(x) > len(y):
+		return 1
+	}
+	return strings.Compare(a, b)
+}